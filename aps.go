@@ -0,0 +1,288 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Alert is the alert dictionary of an APNS payload.
+type Alert struct {
+	Body         string   `json:"body,omitempty"`
+	LocArgs      []string `json:"loc-args,omitempty"`
+	LocKey       string   `json:"loc-key,omitempty"`
+	Subtitle     string   `json:"subtitle,omitempty"`
+	Title        string   `json:"title,omitempty"`
+	TitleLocArgs []string `json:"title-loc-args,omitempty"`
+	TitleLocKey  string   `json:"title-loc-key,omitempty"`
+}
+
+// Aps is the aps dictionary of an APNS payload.
+type Aps struct {
+	Alert            *Alert `json:"alert,omitempty"`
+	Badge            *int   `json:"badge,omitempty"`
+	Category         string `json:"category,omitempty"`
+	ContentAvailable int    `json:"content-available,omitempty"`
+	MutableContent   int    `json:"mutable-content,omitempty"`
+	Sound            string `json:"sound,omitempty"`
+	ThreadID         string `json:"thread-id,omitempty"`
+
+	// Live Activity fields.
+	Attributes     json.RawMessage `json:"attributes,omitempty"`
+	AttributesType string          `json:"attributes-type,omitempty"`
+	ContentState   json.RawMessage `json:"content-state,omitempty"`
+	DismissalDate  *int64          `json:"dismissal-date,omitempty"`
+	Event          string          `json:"event,omitempty"`
+	StaleDate      *int64          `json:"stale-date,omitempty"`
+	Timestamp      int64           `json:"timestamp,omitempty"`
+}
+
+// LiveActivity starts, updates or ends a Live Activity, which is sent with the
+// liveactivity push type to the app's topic plus TopicSuffixLiveActivity.
+type LiveActivity struct {
+	// Attributes and AttributesType are required to start an activity.
+	Attributes     json.RawMessage `json:"attributes"`
+	AttributesType string          `json:"attributes_type"`
+	// ContentState is the activity's ContentState as a JSON object.
+	ContentState  json.RawMessage `json:"content_state"`
+	DismissalDate *int64          `json:"dismissal_date"`
+	// Event is "start", "update" or "end".
+	Event     string `json:"event"`
+	StaleDate *int64 `json:"stale_date"`
+	// Timestamp is the Unix time of the update, which defaults to now. The
+	// device ignores updates older than the last one it got.
+	Timestamp int64 `json:"timestamp"`
+}
+
+const TopicSuffixLiveActivity = ".push-type.liveactivity"
+
+func (a LiveActivity) check() error {
+	switch a.Event {
+	case "start", "update", "end":
+	default:
+		return PayloadError{Reason: fmt.Sprintf("live activity event must be start, update or end, got \"%s\"", a.Event)}
+	}
+	if !isObject(a.ContentState) {
+		return PayloadError{Reason: "live activity content_state must be a JSON object"}
+	}
+	if a.Event == "start" && (a.AttributesType == "" || !isObject(a.Attributes)) {
+		return PayloadError{Reason: "starting a live activity requires attributes_type and attributes"}
+	}
+	return nil
+}
+
+// Reports whether an aps dictionary has anything that alerts the user.
+func alerting(aps map[string]json.RawMessage) bool {
+	for _, key := range []string{"alert", "badge", "sound"} {
+		if _, ok := aps[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the sound to play for the payload when it doesn't say, which is only
+// for notifications that show an alert, so silent pushes stay silent.
+func (p Payload) defaultSound(sound string) string {
+	if sound == "" || p.Sound != "" || p.Silent {
+		return ""
+	}
+	var data struct {
+		Aps map[string]json.RawMessage `json:"aps"`
+	}
+	json.Unmarshal(p.Data, &data)
+	if _, ok := data.Aps["sound"]; ok {
+		return ""
+	}
+	_, alert := data.Aps["alert"]
+	if !alert && p.Title == "" && p.Subtitle == "" && p.Body == "" && !p.localized() {
+		return ""
+	}
+	return sound
+}
+
+// Reports whether an APNS payload alerts the user. Malformed data is assumed to.
+func alertsUser(data json.RawMessage) bool {
+	var payload struct {
+		Aps map[string]json.RawMessage `json:"aps"`
+	}
+	if json.Unmarshal(data, &payload) != nil {
+		return true
+	}
+	return alerting(payload.Aps)
+}
+
+// Reports whether the JSON is an object.
+func isObject(data json.RawMessage) bool {
+	var fields map[string]json.RawMessage
+	return json.Unmarshal(data, &fields) == nil && fields != nil
+}
+
+// Apple treats silent pushes that would also alert the user as inconsistent.
+var errSilentAlert = PayloadError{Reason: "silent pushes can't have an alert, badge or sound"}
+
+// Returns true if any of the fields used to build the aps dictionary are set.
+func (p Payload) HasAps() bool {
+	return p.Title != "" || p.Subtitle != "" || p.Body != "" || p.Badge != nil ||
+		p.Sound != "" || p.ThreadID != "" || p.Category != "" ||
+		p.MutableContent || p.Silent || p.localized() || p.LiveActivity != nil
+}
+
+func (p Payload) localized() bool {
+	return p.LocKey != "" || p.TitleLocKey != "" || len(p.LocArgs) > 0 || len(p.TitleLocArgs) > 0
+}
+
+// Decodes loc_args or title_loc_args, which have to go with their key.
+func locArgs(prefix, key string, raw json.RawMessage) ([]string, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+	var args []string
+	if err := json.Unmarshal(raw, &args); err != nil {
+		return nil, PayloadError{Reason: prefix + "loc_args must be a JSON array of strings"}
+	}
+	if key == "" {
+		return nil, PayloadError{Reason: prefix + "loc_args requires " + prefix + "loc_key"}
+	}
+	return args, nil
+}
+
+// APNSData returns the JSON to send to APNS, which is the raw data with any
+// structured fields merged into its aps dictionary. A nil badge leaves the badge
+// as is, while a zero badge clears it.
+func (p Payload) APNSData() (json.RawMessage, error) {
+	if !p.HasAps() {
+		return p.Data, nil
+	}
+	aps := Aps{
+		Badge:    p.Badge,
+		Category: p.Category,
+		Sound:    p.Sound,
+		ThreadID: p.ThreadID,
+	}
+	if p.Title != "" || p.Subtitle != "" || p.Body != "" || p.localized() {
+		aps.Alert = &Alert{Body: p.Body, Subtitle: p.Subtitle, Title: p.Title}
+		var err error
+		if aps.Alert.LocArgs, err = locArgs("", p.LocKey, p.LocArgs); err != nil {
+			return nil, err
+		}
+		if aps.Alert.TitleLocArgs, err = locArgs("title_", p.TitleLocKey, p.TitleLocArgs); err != nil {
+			return nil, err
+		}
+		aps.Alert.LocKey, aps.Alert.TitleLocKey = p.LocKey, p.TitleLocKey
+	}
+	if p.MutableContent {
+		aps.MutableContent = 1
+	}
+	if a := p.LiveActivity; a != nil {
+		if err := a.check(); err != nil {
+			return nil, err
+		}
+		aps.ContentState, aps.Event = a.ContentState, a.Event
+		aps.DismissalDate, aps.StaleDate = a.DismissalDate, a.StaleDate
+		aps.Timestamp = a.Timestamp
+		if aps.Timestamp == 0 {
+			aps.Timestamp = time.Now().Unix()
+		}
+		if a.Event == "start" {
+			aps.Attributes, aps.AttributesType = a.Attributes, a.AttributesType
+		}
+	}
+	if p.Silent {
+		if aps.Alert != nil || aps.Badge != nil || aps.Sound != "" {
+			return nil, errSilentAlert
+		}
+		aps.ContentAvailable = 1
+	}
+	if len(p.Data) == 0 {
+		return json.Marshal(map[string]Aps{"aps": aps})
+	}
+	var data map[string]json.RawMessage
+	if err := json.Unmarshal(p.Data, &data); err != nil {
+		return nil, PayloadError{Reason: "data is not a JSON object"}
+	}
+	if data == nil {
+		data = make(map[string]json.RawMessage)
+	}
+	merged := make(map[string]json.RawMessage)
+	if raw, ok := data["aps"]; ok {
+		if err := json.Unmarshal(raw, &merged); err != nil || merged == nil {
+			return nil, PayloadError{Reason: "aps is not a JSON object"}
+		}
+	}
+	// Round trip the structured fields to get just the ones that are set.
+	fields, err := json.Marshal(aps)
+	if err != nil {
+		return nil, err
+	}
+	var overrides map[string]json.RawMessage
+	if err := json.Unmarshal(fields, &overrides); err != nil {
+		return nil, err
+	}
+	for key, value := range overrides {
+		merged[key] = value
+	}
+	if p.Silent {
+		for _, key := range []string{"alert", "badge", "sound"} {
+			if _, ok := merged[key]; ok {
+				return nil, errSilentAlert
+			}
+		}
+	}
+	if data["aps"], err = json.Marshal(merged); err != nil {
+		return nil, err
+	}
+	return json.Marshal(data)
+}
+
+// Checks that the data is a JSON object and its aps dictionary, if it has one,
+// is an object too. APNS would reject anything else, so this saves the round
+// trip. The data itself is sent as is.
+func checkData(data json.RawMessage) error {
+	if len(data) == 0 {
+		return nil
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil || fields == nil {
+		return PayloadError{Reason: "data is not a JSON object"}
+	}
+	if raw, ok := fields["aps"]; ok && !isObject(raw) {
+		return PayloadError{Reason: "aps is not a JSON object"}
+	}
+	return nil
+}
+
+// Checks that the push type, priority and aps dictionary make sense together,
+// since APNS or iOS would otherwise reject or silently drop the notification.
+// No priority counts as 10, which is what APNS assumes without the header:
+//
+//	push type    priority  aps
+//	background   5         no alert, badge or sound
+//	any other    5         anything
+//	any other    10        anything but only content-available
+func checkCombination(pushType string, priority int, data json.RawMessage) error {
+	if priority == 0 {
+		priority = 10
+	}
+	var payload struct {
+		Aps map[string]json.RawMessage `json:"aps"`
+	}
+	// Malformed data is for APNS to reject.
+	if json.Unmarshal(data, &payload) != nil {
+		return nil
+	}
+	alerts := alerting(payload.Aps)
+	_, contentAvailable := payload.Aps["content-available"]
+	contentState, hasContentState := payload.Aps["content-state"]
+	switch {
+	case pushType == "liveactivity" && (!hasContentState || !isObject(contentState)):
+		return PayloadError{Reason: "liveactivity pushes must have a content-state object"}
+	case pushType == "background" && priority == 10:
+		return PayloadError{Reason: "background pushes must have priority 5"}
+	case pushType == "background" && alerts:
+		return PayloadError{Reason: "background pushes can't have an alert, badge or sound"}
+	case priority == 10 && contentAvailable && len(payload.Aps) == 1:
+		return PayloadError{Reason: "pushes with only content-available must have priority 5"}
+	}
+	return nil
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultBreakerCooldown    = 30 * time.Second
+	DefaultBreakerMinRequests = 20
+	DefaultBreakerThreshold   = 50
+	// Failure rates are measured over windows of this length.
+	BreakerWindow = time.Minute
+)
+
+const (
+	BreakerClosed   = "closed"
+	BreakerOpen     = "open"
+	BreakerHalfOpen = "half-open"
+)
+
+// Breaker settings, shared by every app.
+var (
+	breakerCooldown    = DefaultBreakerCooldown
+	breakerMinRequests = DefaultBreakerMinRequests
+	breakerThreshold   = DefaultBreakerThreshold
+)
+
+// CircuitOpenError is returned instead of pushing while an app's breaker is
+// open, so nothing was sent.
+type CircuitOpenError struct {
+	App string
+}
+
+func (e CircuitOpenError) Error() string {
+	return fmt.Sprintf("circuit breaker for %s is open", e.App)
+}
+
+// Breaker stops pushes to an app while APNS keeps failing for it. It opens once
+// at least breakerThreshold percent of breakerMinRequests or more requests in a
+// window have failed, and lets a single probe through after breakerCooldown.
+// The probe closes it again if it succeeds.
+type Breaker struct {
+	mu       sync.Mutex
+	state    string
+	window   time.Time
+	requests int
+	failures int
+	opened   time.Time
+	probing  bool
+}
+
+// Allow reports whether a request may be sent right now.
+func (b *Breaker) Allow() bool {
+	if breakerThreshold <= 0 {
+		return true
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.opened) < breakerCooldown {
+			return false
+		}
+		b.state = BreakerHalfOpen
+		b.probing = true
+		return true
+	case BreakerHalfOpen:
+		// Only one probe at a time.
+		if b.probing {
+			return false
+		}
+		b.probing = true
+		return true
+	}
+	return true
+}
+
+// Record adds the outcome of a request that Allow let through. Only server and
+// connection errors count as failures, since APNS was healthy enough to reject
+// anything else.
+func (b *Breaker) Record(failed bool) {
+	if breakerThreshold <= 0 {
+		return
+	}
+	now := time.Now()
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == BreakerHalfOpen {
+		b.probing = false
+		if failed {
+			b.state = BreakerOpen
+			b.opened = now
+			return
+		}
+		b.state = BreakerClosed
+		b.window, b.requests, b.failures = now, 0, 0
+		return
+	}
+	if now.Sub(b.window) > BreakerWindow {
+		b.window, b.requests, b.failures = now, 0, 0
+	}
+	b.requests++
+	if failed {
+		b.failures++
+	}
+	if b.requests >= breakerMinRequests && b.failures*100 >= b.requests*breakerThreshold {
+		b.state = BreakerOpen
+		b.opened = now
+	}
+}
+
+// State returns whether the breaker is closed, open or half-open.
+func (b *Breaker) State() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.state == "" {
+		return BreakerClosed
+	}
+	return b.state
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+// Codes returned in Result.Code, so that callers can branch on why a push
+// failed without parsing the error message. The apns_ codes are also used for
+// the equivalent FCM and Web Push errors.
+const (
+	// The app was disabled through /admin/disable.
+	CodeAppDisabled = "app_disabled"
+	// The push was canceled, e.g. because the request or the server shut down.
+	CodeCanceled = "canceled"
+	// The circuit breaker for the app is open, so the push wasn't attempted.
+	CodeCircuitOpen = "circuit_open"
+	// The app's certificate or signing key was rejected.
+	CodeCredentials = "apns_credentials"
+	// The device has been disabled after failing too many times in a row.
+	CodeDeviceDisabled = "device_disabled"
+	// An identical payload was pushed within DEDUP_WINDOW.
+	CodeDuplicate = "duplicate"
+	// Anything else, most likely a connection failure.
+	CodeInternal = "internal_error"
+	// The payload line or array element wasn't valid JSON.
+	CodeInvalidJSON = "invalid_json"
+	// The payload failed validation and has to change before it can succeed.
+	CodeInvalidPayload = "invalid_payload"
+	// The device token is malformed or no longer valid, and has been deleted.
+	CodeInvalidToken = "invalid_token"
+	// The notification was rejected permanently for a reason not covered above.
+	CodePermanent = "apns_permanent"
+	// The payload or its data is over the size limit.
+	CodePayloadTooLarge = "payload_too_large"
+	// The device got more than RATE_LIMIT pushes in the last minute.
+	CodeRateLimited = "rate_limited"
+	// The request had more than MAX_LINES payloads, and the rest weren't pushed.
+	CodeTooManyPayloads = "too_many_payloads"
+	// The provider asked us to slow down, and retrying didn't get through.
+	CodeThrottled = "apns_throttled"
+	// The provider kept failing with server errors.
+	CodeUnavailable = "apns_unavailable"
+	// The app is missing or isn't configured.
+	CodeUnknownApp = "unknown_app"
+)
+
+// ErrorCode maps an error returned while pushing onto one of the codes above.
+func ErrorCode(err error) string {
+	var (
+		appErr     UnknownAppError
+		circuitErr CircuitOpenError
+		payloadErr PayloadError
+		pushErr    PushError
+	)
+	switch {
+	case err == nil:
+		return ""
+	case errors.As(err, &appErr):
+		return CodeUnknownApp
+	case errors.As(err, &circuitErr):
+		return CodeCircuitOpen
+	case errors.As(err, &payloadErr):
+		if payloadErr.BadToken {
+			return CodeInvalidToken
+		}
+		if payloadErr.TooLarge {
+			return CodePayloadTooLarge
+		}
+		return CodeInvalidPayload
+	case errors.As(err, &pushErr):
+		switch {
+		case pushErr.Reason == "PayloadTooLarge" || pushErr.StatusCode == http.StatusRequestEntityTooLarge:
+			return CodePayloadTooLarge
+		case pushErr.StatusCode == http.StatusTooManyRequests:
+			return CodeThrottled
+		case pushErr.BadToken():
+			return CodeInvalidToken
+		case pushErr.CertificateProblem():
+			return CodeCredentials
+		case pushErr.Permanent():
+			return CodePermanent
+		}
+		return CodeUnavailable
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return CodeCanceled
+	}
+	return CodeInternal
+}
@@ -0,0 +1,109 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+const DefaultDailyCountsFlushInterval = time.Minute
+
+// DailyCount is the number of pushes for an app and environment that resolved
+// on a UTC day, stored with the key "<date>/<app>/<environment>".
+type DailyCount struct {
+	App         string    `datastore:"app"`
+	Date        string    `datastore:"date"`
+	Dropped     int       `datastore:"dropped,noindex"`
+	Environment string    `datastore:"environment"`
+	Failed      int       `datastore:"failed,noindex"`
+	Pushed      int       `datastore:"pushed,noindex"`
+	Succeeded   int       `datastore:"succeeded,noindex"`
+	Updated     time.Time `datastore:"updated,noindex"`
+}
+
+func (c *DailyCount) add(other DailyCount) {
+	c.Dropped += other.Dropped
+	c.Failed += other.Failed
+	c.Pushed += other.Pushed
+	c.Succeeded += other.Succeeded
+}
+
+// DailyCounters adds up push outcomes in memory and periodically adds them to
+// the DailyCount entities, so that counting costs one write per app, environment
+// and day every flush rather than one per push.
+type DailyCounters struct {
+	mu      sync.Mutex
+	pending map[string]*DailyCount
+}
+
+func NewDailyCounters() *DailyCounters {
+	return &DailyCounters{pending: make(map[string]*DailyCount)}
+}
+
+// Add counts the outcome of a push towards the current UTC day.
+func (c *DailyCounters) Add(payload Payload, result Result) {
+	env := payload.Environment
+	if env == "" {
+		env = "production"
+	}
+	delta := DailyCount{App: payload.App, Date: time.Now().UTC().Format("2006-01-02"), Environment: env, Pushed: 1}
+	switch {
+	case result.Success:
+		delta.Succeeded = 1
+	case result.Permanent:
+		delta.Failed = 1
+	default:
+		delta.Dropped = 1
+	}
+	c.merge(delta)
+}
+
+func (c *DailyCounters) merge(delta DailyCount) {
+	name := fmt.Sprintf("%s/%s/%s", delta.Date, delta.App, delta.Environment)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if count, ok := c.pending[name]; ok {
+		count.add(delta)
+	} else {
+		c.pending[name] = &delta
+	}
+}
+
+// Run flushes the counts every interval.
+func (c *DailyCounters) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		c.Flush()
+	}
+}
+
+// Flush adds the pending counts to datastore. Counts that fail to be written
+// are kept for the next flush.
+func (c *DailyCounters) Flush() {
+	c.mu.Lock()
+	pending := c.pending
+	c.pending = make(map[string]*DailyCount)
+	c.mu.Unlock()
+	for name, delta := range pending {
+		key := datastore.NameKey("DailyCount", name, nil)
+		_, err := store.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+			var count DailyCount
+			if err := tx.Get(key, &count); err != nil && err != datastore.ErrNoSuchEntity {
+				return err
+			}
+			count.App, count.Date, count.Environment = delta.App, delta.Date, delta.Environment
+			count.add(*delta)
+			count.Updated = time.Now()
+			_, err := tx.Put(key, &count)
+			return err
+		})
+		if err != nil {
+			datastoreErrors.Error(slog.Default(), "Failed to flush daily counts", "event", "daily_counts_flush_failed", "key", name, "error", err)
+			c.merge(*delta)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// FailedPush is a notification that could not be delivered, kept around so it
+// can be audited and replayed.
+type FailedPush struct {
+	AccountID   int64     `datastore:"account_id"`
+	App         string    `datastore:"app"`
+	Created     time.Time `datastore:"created"`
+	DeviceToken string    `datastore:"device_token,noindex"`
+	Error       string    `datastore:"error,noindex"`
+	// Payload is the full payload as JSON.
+	Payload []byte `datastore:"payload,noindex"`
+}
+
+// Stores a notification that was dropped or failed permanently.
+func deadLetter(ctx context.Context, logger *slog.Logger, payload Payload, reason string) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		logger.Error("Failed to encode dead letter", "event", "dead_letter_failed", "error", err)
+		return
+	}
+	failed := &FailedPush{
+		AccountID:   payload.AccountID,
+		App:         payload.App,
+		Created:     time.Now(),
+		DeviceToken: payload.DeviceToken,
+		Error:       reason,
+		Payload:     data,
+	}
+	if _, err := store.Put(ctx, datastore.IncompleteKey("FailedPush", nil), failed); err != nil {
+		logger.Error("Failed to store dead letter", "event", "dead_letter_failed", "error", err)
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// Dedup remembers the payloads recently pushed to each device so that
+// duplicates can be dropped.
+type Dedup struct {
+	Window time.Duration
+
+	mu     sync.Mutex
+	seen   map[[sha256.Size]byte]time.Time
+	pruned time.Time
+}
+
+func NewDedup(window time.Duration) *Dedup {
+	return &Dedup{Window: window, seen: make(map[[sha256.Size]byte]time.Time)}
+}
+
+// DedupKey identifies a notification by its device token, the body that would
+// be pushed, including anything assembled from the structured fields, and the
+// fields that change how it's delivered.
+func DedupKey(payload Payload) [sha256.Size]byte {
+	data, err := payload.APNSData()
+	if err != nil {
+		data = payload.Data
+	}
+	fields, _ := json.Marshal(struct {
+		CollapseID  string
+		Data        []byte
+		DeviceToken string
+		Priority    int
+		PushType    string
+		Silent      bool
+		Topic       string
+	}{payload.CollapseID, data, payload.DeviceToken, payload.Priority, payload.PushType, payload.Silent, payload.Topic})
+	return sha256.Sum256(fields)
+}
+
+// Seen reports whether a notification with the same key was seen within the
+// window, and remembers it if not. Pushes that don't succeed should Forget it
+// again, so that they can be resent.
+func (d *Dedup) Seen(key [sha256.Size]byte) bool {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if now.Sub(d.pruned) > d.Window {
+		for k, t := range d.seen {
+			if now.Sub(t) > d.Window {
+				delete(d.seen, k)
+			}
+		}
+		d.pruned = now
+	}
+	if t, ok := d.seen[key]; ok && now.Sub(t) <= d.Window {
+		return true
+	}
+	d.seen[key] = now
+	return false
+}
+
+// Forget makes the notification with the key count as unseen again.
+func (d *Dedup) Forget(key [sha256.Size]byte) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.seen, key)
+}
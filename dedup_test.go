@@ -0,0 +1,27 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDedupStructuredFields(t *testing.T) {
+	d := NewDedup(time.Minute)
+	hi := Payload{DeviceToken: testToken, Body: "Hi"}
+	if d.Seen(DedupKey(hi)) {
+		t.Fatal("first push was a duplicate")
+	}
+	if !d.Seen(DedupKey(hi)) {
+		t.Error("identical push wasn't a duplicate")
+	}
+	if d.Seen(DedupKey(Payload{DeviceToken: testToken, Body: "Bye"})) {
+		t.Error("push with a different body was a duplicate")
+	}
+	if d.Seen(DedupKey(Payload{DeviceToken: testToken, Body: "Hi", CollapseID: "a"})) {
+		t.Error("push with a different collapse_id was a duplicate")
+	}
+	d.Forget(DedupKey(hi))
+	if d.Seen(DedupKey(hi)) {
+		t.Error("forgotten push was a duplicate")
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Apps that operators have stopped pushing for, e.g. during an incident.
+var disabledApps = NewDisabledApps()
+
+// DisabledApps is the set of disabled apps and when each was disabled. It only
+// lives in memory, so every app is enabled again after a restart.
+type DisabledApps struct {
+	mu   sync.RWMutex
+	apps map[string]time.Time
+}
+
+func NewDisabledApps() *DisabledApps {
+	return &DisabledApps{apps: make(map[string]time.Time)}
+}
+
+// Disabled reports whether pushes for the app are being dropped.
+func (d *DisabledApps) Disabled(app string) bool {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	_, ok := d.apps[app]
+	return ok
+}
+
+func (d *DisabledApps) Set(app string, disabled bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if !disabled {
+		delete(d.apps, app)
+	} else if _, ok := d.apps[app]; !ok {
+		d.apps[app] = time.Now()
+	}
+}
+
+// All returns a snapshot of the disabled apps.
+func (d *DisabledApps) All() map[string]time.Time {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	all := make(map[string]time.Time, len(d.apps))
+	for app, since := range d.apps {
+		all[app] = since
+	}
+	return all
+}
+
+// Disables or enables an app, given a JSON object with the app and whether it
+// should be disabled. Responds with all the disabled apps.
+func disableAppHandler(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		App      string `json:"app"`
+		Disabled bool   `json:"disabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, fmt.Sprintf("invalid JSON: %s", err), http.StatusBadRequest)
+		return
+	}
+	if _, ok := clients.Get(params.App); !ok {
+		http.Error(w, fmt.Sprintf("invalid app \"%s\"", params.App), http.StatusNotFound)
+		return
+	}
+	disabledApps.Set(params.App, params.Disabled)
+	if params.Disabled {
+		slog.Warn("Disabled app", "event", "app_disabled", "app", params.App)
+	} else {
+		slog.Warn("Enabled app", "event", "app_enabled", "app", params.App)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(disabledApps.All())
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Returns the duration in the environment variable, or fallback if it's unset.
+func getenvDuration(name string, fallback time.Duration) time.Duration {
+	s := os.Getenv(name)
+	if s == "" {
+		return fallback
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		log.Fatalf("Invalid duration %s=%#v: %v", name, s, err)
+	}
+	return d
+}
+
+// Returns the integer in the environment variable, or fallback if it's unset.
+func getenvInt(name string, fallback int) int {
+	s := os.Getenv(name)
+	if s == "" {
+		return fallback
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		log.Fatalf("Invalid integer %s=%#v: %v", name, s, err)
+	}
+	return n
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	FCMHost  = "https://fcm.googleapis.com"
+	FCMScope = "https://www.googleapis.com/auth/firebase.messaging"
+)
+
+var fcmClient *http.Client
+
+type fcmError struct {
+	Error struct {
+		Code    int    `json:"code"`
+		Message string `json:"message"`
+		Status  string `json:"status"`
+		Details []struct {
+			ErrorCode string `json:"errorCode"`
+		} `json:"details"`
+	} `json:"error"`
+}
+
+// Maps FCM error codes onto the APNS status codes that PushError understands.
+var fcmStatusCodes = map[string]int{
+	"INVALID_ARGUMENT":       400,
+	"SENDER_ID_MISMATCH":     400,
+	"THIRD_PARTY_AUTH_ERROR": 403,
+	"UNREGISTERED":           410,
+	"QUOTA_EXCEEDED":         429,
+	"INTERNAL":               500,
+	"UNAVAILABLE":            503,
+}
+
+// NewFCMClient creates an HTTP client that authorizes requests with an OAuth2
+// bearer token from the default Google credentials.
+func NewFCMClient(ctx context.Context) (*http.Client, error) {
+	client, err := google.DefaultClient(ctx, FCMScope)
+	if err != nil {
+		return nil, err
+	}
+	client.Timeout = 3 * time.Second
+	return client, nil
+}
+
+// PushFCM sends a single notification through the FCM HTTP v1 API and returns
+// the message name it was assigned, and how long FCM took to respond. The
+// payload data is the FCM message object, to which the device token is added.
+func PushFCM(ctx context.Context, payload Payload) (messageID string, latency time.Duration, err error) {
+	if fcmClient == nil {
+		err = fmt.Errorf("FCM is not configured")
+		return
+	}
+	message := make(map[string]json.RawMessage)
+	if len(payload.Data) > 0 {
+		if err = json.Unmarshal(payload.Data, &message); err != nil {
+			err = PayloadError{Reason: fmt.Sprintf("data is not a JSON object: %v", err)}
+			return
+		}
+	}
+	message["token"], _ = json.Marshal(payload.DeviceToken)
+	request := map[string]interface{}{"message": message}
+	if payload.DryRun {
+		request["validate_only"] = true
+	}
+	body, err := json.Marshal(request)
+	if err != nil {
+		return
+	}
+	url := fmt.Sprintf("%s/v1/projects/%s/messages:send", FCMHost, projectId)
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	start := time.Now()
+	resp, err := fcmClient.Do(req)
+	latency = time.Since(start)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	body, err = ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	if resp.StatusCode == http.StatusOK {
+		var result struct {
+			Name string `json:"name"`
+		}
+		if err = json.Unmarshal(body, &result); err != nil {
+			return
+		}
+		messageID = result.Name
+		return
+	}
+	statusCode, reason := fcmErrorDetails(resp.StatusCode, body)
+	err = PushError{Body: body, Reason: reason, StatusCode: statusCode}
+	return
+}
+
+// Picks the most specific error code for an FCM error response, and the APNS
+// status code it corresponds to.
+func fcmErrorDetails(statusCode int, body []byte) (int, string) {
+	var fe fcmError
+	if err := json.Unmarshal(body, &fe); err != nil {
+		return statusCode, ""
+	}
+	for _, detail := range fe.Error.Details {
+		if code, ok := fcmStatusCodes[detail.ErrorCode]; ok {
+			return code, detail.ErrorCode
+		}
+	}
+	if code, ok := fcmStatusCodes[fe.Error.Status]; ok {
+		return code, fe.Error.Status
+	}
+	return statusCode, fe.Error.Status
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Clients that pushed successfully within this long are assumed to be healthy.
+const ReadyWindow = 5 * time.Minute
+
+const DefaultCertExpiryWarningDays = 30
+
+// Certificates expiring within this long are warned about.
+var certExpiryWarning = time.Duration(getenvInt("CERT_EXPIRY_WARNING_DAYS", DefaultCertExpiryWarningDays)) * 24 * time.Hour
+
+// Responds with a 200 OK if datastore is reachable and at least one app can
+// reach APNS, and a 503 otherwise. Certificates that are about to expire are
+// listed in the response, but don't make it fail.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	if err := checkDatastore(ctx); err != nil {
+		slog.Warn("Datastore is unhealthy", "event", "not_ready", "error", err)
+		http.Error(w, fmt.Sprintf("datastore: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	if err := checkClients(ctx); err != nil {
+		slog.Warn("APNS is unhealthy", "event", "not_ready", "error", err)
+		http.Error(w, fmt.Sprintf("apns: %v", err), http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+	for _, warning := range expiringCertificates() {
+		fmt.Fprintf(w, "warning: %s\n", warning)
+	}
+}
+
+// Describes every app whose certificate expires within certExpiryWarning.
+func expiringCertificates() (warnings []string) {
+	for app, client := range clients.All() {
+		expires := client.CertificateExpiry()
+		if expires.IsZero() || time.Until(expires) >= certExpiryWarning {
+			continue
+		}
+		if time.Now().After(expires) {
+			warnings = append(warnings, fmt.Sprintf("certificate for %s expired on %s", app, expires.Format(time.RFC3339)))
+		} else {
+			warnings = append(warnings, fmt.Sprintf("certificate for %s expires on %s", app, expires.Format(time.RFC3339)))
+		}
+	}
+	sort.Strings(warnings)
+	return
+}
+
+// Looks up a device that doesn't exist, which only fails if datastore does.
+func checkDatastore(ctx context.Context) error {
+	var device Device
+	err := store.Get(ctx, datastore.NameKey("Device", "ready-check", nil), &device)
+	if err == datastore.ErrNoSuchEntity {
+		return nil
+	}
+	return err
+}
+
+// Succeeds if any client pushed recently, or failing that, can get any
+// response at all out of APNS.
+func checkClients(ctx context.Context) error {
+	all := clients.All()
+	if len(all) == 0 {
+		return fmt.Errorf("no apps configured")
+	}
+	for _, client := range all {
+		if time.Since(client.Status().LastSuccess) < ReadyWindow {
+			return nil
+		}
+	}
+	var err error
+	for _, client := range all {
+		var req *http.Request
+		if req, err = http.NewRequestWithContext(ctx, "HEAD", client.Host(), nil); err != nil {
+			return err
+		}
+		var resp *http.Response
+		if resp, err = client.Do(req); err == nil {
+			resp.Body.Close()
+			return nil
+		}
+	}
+	return err
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const DefaultIdempotencyTTL = time.Hour
+
+// Remembers the responses to requests with an Idempotency-Key header when
+// IDEMPOTENCY_TTL isn't 0, otherwise nil.
+var idempotency *Idempotency
+
+// Idempotency replays the response to a request when it's repeated with the
+// same Idempotency-Key within TTL, instead of handling it again.
+type Idempotency struct {
+	TTL time.Duration
+
+	mu        sync.Mutex
+	responses map[string]*storedResponse
+	pruned    time.Time
+}
+
+type storedResponse struct {
+	// Closed once the response below is complete.
+	done    chan struct{}
+	created time.Time
+	status  int
+	header  http.Header
+	body    []byte
+}
+
+func NewIdempotency(ttl time.Duration) *Idempotency {
+	return &Idempotency{TTL: ttl, responses: make(map[string]*storedResponse)}
+}
+
+// Wraps a handler so that its requests are handled at most once per key.
+// Streaming requests are always handled, since they can't be replayed.
+func idempotent(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get("Idempotency-Key")
+		stream, _ := strconv.ParseBool(r.URL.Query().Get("stream"))
+		if idempotency == nil || key == "" || stream {
+			handler(w, r)
+			return
+		}
+		idempotency.serve(r.URL.Path+" "+key, handler, w, r)
+	}
+}
+
+func (i *Idempotency) serve(key string, handler http.HandlerFunc, w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	i.mu.Lock()
+	if now.Sub(i.pruned) > i.TTL {
+		for k, stored := range i.responses {
+			if now.Sub(stored.created) > i.TTL {
+				delete(i.responses, k)
+			}
+		}
+		i.pruned = now
+	}
+	stored, ok := i.responses[key]
+	if ok && now.Sub(stored.created) <= i.TTL {
+		i.mu.Unlock()
+		select {
+		case <-stored.done:
+		default:
+			http.Error(w, "a request with this Idempotency-Key is still in progress", http.StatusConflict)
+			return
+		}
+		for name, values := range stored.header {
+			w.Header()[name] = values
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(stored.status)
+		w.Write(stored.body)
+		return
+	}
+	stored = &storedResponse{done: make(chan struct{}), created: now}
+	i.responses[key] = stored
+	i.mu.Unlock()
+
+	recorder := &responseRecorder{ResponseWriter: w, status: http.StatusOK}
+	handler(recorder, r)
+	stored.status, stored.header, stored.body = recorder.status, w.Header().Clone(), recorder.body.Bytes()
+	close(stored.done)
+	// Let server errors be retried.
+	if stored.status >= 500 {
+		i.mu.Lock()
+		delete(i.responses, key)
+		i.mu.Unlock()
+	}
+}
+
+// Passes a response through while keeping a copy of it.
+type responseRecorder struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *responseRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status, r.wroteHeader = status, true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *responseRecorder) Write(data []byte) (int, error) {
+	r.wroteHeader = true
+	r.body.Write(data)
+	return r.ResponseWriter.Write(data)
+}
+
+// Lets http.ResponseController reach the underlying writer.
+func (r *responseRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
@@ -3,275 +3,2383 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"log"
-	"math"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"cloud.google.com/go/datastore"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"golang.org/x/net/http2"
 )
 
 type Device struct {
 	ApiVersion     int       `datastore:"api_version,noindex"`
 	App            string    `datastore:"app"`
+	AvgLatencyMs   float64   `datastore:"avg_latency_ms,noindex"`
 	Created        time.Time `datastore:"created,noindex"`
 	DeviceId       string    `datastore:"device_id,noindex"`
 	DeviceInfo     string    `datastore:"device_info,noindex"`
+	Disabled       time.Time `datastore:"disabled,noindex"`
 	Environment    string    `datastore:"environment,noindex"`
 	Failures       int       `datastore:"failures,noindex"`
+	LastLatencyMs  int64     `datastore:"last_latency_ms,noindex"`
 	LastSuccess    time.Time `datastore:"last_success,noindex"`
 	Platform       string    `datastore:"platform,noindex"`
 	Token          string    `datastore:"token"`
 	TotalFailures  int       `datastore:"total_failures,noindex"`
+	TotalRetries   int       `datastore:"total_retries,noindex"`
 	TotalSuccesses int       `datastore:"total_successes,noindex"`
 	Updated        time.Time `datastore:"updated,noindex"`
 }
 
+// Payload is a single notification to deliver. The aps dictionary is taken from
+// Data, with Badge, Body, Category, Sound, Subtitle, ThreadID, Title and the
+// localization keys merged into it when set.
 type Payload struct {
-	AccountID   int64           `json:"account_id"`
-	App         string          `json:"app"`
+	AccountID int64  `json:"account_id"`
+	App       string `json:"app"`
+	Badge     *int   `json:"badge"`
+	Body      string `json:"body"`
+	Category  string `json:"category"`
+	// CollapseID makes the notification replace any earlier one with the same
+	// collapse ID, e.g. when editing a message. It's independent of ID, so both
+	// can be set to also have APNS recognize retries of the replacement.
+	CollapseID  string          `json:"collapse_id"`
 	Data        json.RawMessage `json:"data"`
 	DeviceToken string          `json:"device_token"`
-	Environment string          `json:"environment"`
+	// DryRun validates the payload and reports the request that would be made
+	// without delivering anything.
+	DryRun bool `json:"dry_run"`
+	// Environment is "production", "development", or "auto" to use the device's
+	// environment and fall back to the other one if APNS rejects the token.
+	Environment string `json:"environment"`
+	// Expiration is the Unix time after which APNS should stop trying to
+	// deliver the notification. Zero means deliver immediately or not at all.
+	Expiration *int64 `json:"expiration"`
+	// ID is sent as the apns-id so that APNS can tell retries apart from new
+	// notifications. It has to be a UUID, and APNS generates one if it's empty.
+	ID string `json:"id"`
+	// Important pushes are retried harder, following importantRetryPolicy, and
+	// logged as errors if they still end up dropped.
+	Important bool `json:"important"`
+	// Immediate makes APNS try delivering only once, right away, and discard the
+	// notification if the device is offline. This is the same as an Expiration
+	// of zero.
+	Immediate bool `json:"immediate"`
+	// LiveActivity makes this a Live Activity push.
+	LiveActivity *LiveActivity `json:"live_activity"`
+	// LocKey and TitleLocKey are keys into the app's Localizable.strings for the
+	// alert body and title, which the device formats with LocArgs and
+	// TitleLocArgs, JSON arrays of strings.
+	LocArgs json.RawMessage `json:"loc_args"`
+	LocKey  string          `json:"loc_key"`
+	// MutableContent lets a notification service extension modify the
+	// notification before it's shown, e.g. to attach an image.
+	MutableContent bool `json:"mutable_content"`
+	// Namespace is the datastore namespace of the account and device, which
+	// defaults to the app's namespace.
+	Namespace string `json:"namespace"`
+	Platform  string `json:"platform"`
+	Priority  int    `json:"priority"`
+	PushType  string `json:"push_type"`
+	// Silent makes this a background push with content-available set, which
+	// also needs the background push type and priority 5.
+	Silent       bool            `json:"silent"`
+	Sound        string          `json:"sound"`
+	Subtitle     string          `json:"subtitle"`
+	ThreadID     string          `json:"thread_id"`
+	Title        string          `json:"title"`
+	TitleLocArgs json.RawMessage `json:"title_loc_args"`
+	TitleLocKey  string          `json:"title_loc_key"`
+	// Topic overrides the apns-topic, which defaults to the app's topic. It has
+	// to be the app's bundle ID plus a suffix, e.g. "<app>.voip".
+	Topic string `json:"topic"`
+
+	// The key for AccountID, if it was already built for another payload.
+	accountKey *datastore.Key
+	// Set for payloads replayed from a dead letter, which already exists.
+	replay bool
+}
+
+// AccountKey returns the datastore key of the account the payload is for.
+func (p Payload) AccountKey() *datastore.Key {
+	if p.accountKey != nil {
+		return p.accountKey
+	}
+	namespace := p.Namespace
+	if client, ok := clients.Get(p.App); ok && namespace == "" {
+		namespace = client.Config.Namespace
+	}
+	key := datastore.IDKey("Account", p.AccountID, nil)
+	key.Namespace = namespace
+	return key
+}
+
+// DeviceKey returns the datastore key of the device with the token, which
+// belongs to the account and lives in the same namespace.
+func DeviceKey(token string, account *datastore.Key) *datastore.Key {
+	key := datastore.NameKey("Device", token, account)
+	key.Namespace = account.Namespace
+	return key
+}
+
+// PayloadError is returned when a payload is rejected before it's sent to APNS.
+// Retrying will never succeed since the payload itself has to change.
+type PayloadError struct {
+	// BadToken is set when the device token itself is malformed.
+	BadToken bool
+	Reason   string
+	// TooLarge is set when the data is over the size limit.
+	TooLarge bool
+}
+
+func (pe PayloadError) Error() string {
+	return fmt.Sprintf("invalid payload (%s)", pe.Reason)
+}
+
+// UnknownAppError is returned for payloads with an app that isn't configured.
+type UnknownAppError struct {
+	App string
+}
+
+func (e UnknownAppError) Error() string {
+	return fmt.Sprintf("invalid app \"%s\"", e.App)
 }
 
 type PushError struct {
-	Body       []byte
+	ApnsID string
+	Body   []byte
+	// Reason is the error code from the response body, e.g. "BadDeviceToken".
+	Reason string
+	// RetryAfter is how long the provider asked us to wait, if it said so.
+	RetryAfter time.Duration
 	StatusCode int
+	// Timestamp is when APNS found the token to be no longer valid, which it
+	// includes with 410 responses.
+	Timestamp time.Time
 }
 
 func (pe PushError) Error() string {
-	return fmt.Sprintf("HTTP %d (%s)", pe.StatusCode, pe.Body)
+	return fmt.Sprintf("HTTP %d (%s) [apns-id %s]", pe.StatusCode, pe.Body, pe.ApnsID)
 }
 
 func (pe PushError) Permanent() bool {
-	return pe.StatusCode == 400 || pe.StatusCode == 410
+	if pe.Reason == "ExpiredProviderToken" {
+		return false
+	}
+	return pe.StatusCode == 400 || pe.StatusCode == 403 || pe.StatusCode == 410
+}
+
+// BadToken means the device token itself was rejected and should be deleted.
+func (pe PushError) BadToken() bool {
+	switch pe.Reason {
+	case "BadDeviceToken", "DeviceTokenNotForTopic", "Unregistered", "UNREGISTERED":
+		return true
+	case "":
+		return pe.StatusCode == 400 || pe.StatusCode == 410
+	}
+	return false
+}
+
+// CertificateProblem means the app's credentials were rejected, which is not
+// the fault of the device token.
+func (pe PushError) CertificateProblem() bool {
+	return pe.StatusCode == 403 && pe.Reason != "ExpiredProviderToken"
+}
+
+// DeviceFailure means the push failed because of the device rather than the
+// provider, the app or the payload, which is only the case when APNS says the
+// device is getting too many pushes. Only these count toward disabling it,
+// since rejected tokens are deleted instead.
+func (pe PushError) DeviceFailure() bool {
+	return pe.StatusCode == http.StatusTooManyRequests && pe.Reason == "TooManyRequests"
 }
 
 func (pe PushError) Retryable() bool {
+	// An expired provider token is regenerated before the retry.
+	if pe.Reason == "ExpiredProviderToken" {
+		return true
+	}
 	return pe.StatusCode == 429 || pe.StatusCode == 500 || pe.StatusCode == 503
 }
 
-type ClientMap map[string]*http.Client
+// Result is the outcome of delivering a single payload.
+type Result struct {
+	// Code says why the push failed, as one of the Code constants.
+	Code  string `json:"code,omitempty"`
+	Error string `json:"error,omitempty"`
+	ID    string `json:"id,omitempty"`
+	// Permanent is set for failures that will never succeed, as opposed to
+	// notifications that were dropped after giving up on retries.
+	Permanent bool `json:"permanent,omitempty"`
+	// Request is the request that would have been sent, for dry runs.
+	Request    *RequestInfo `json:"request,omitempty"`
+	StatusCode int          `json:"status_code,omitempty"`
+	Success    bool         `json:"success"`
+}
+
+type RequestInfo struct {
+	Body    string            `json:"body"`
+	Headers map[string]string `json:"headers"`
+	URL     string            `json:"url"`
+}
+
+func NewResult(id string, err error) Result {
+	if err == nil {
+		return Result{ID: id, StatusCode: http.StatusOK, Success: true}
+	}
+	result := Result{Code: ErrorCode(err), ID: id, Error: err.Error()}
+	switch err := err.(type) {
+	case PayloadError:
+		result.Permanent = true
+	case PushError:
+		result.ID = err.ApnsID
+		result.Permanent = err.Permanent()
+		result.StatusCode = err.StatusCode
+	}
+	return result
+}
+
+// Batch is a single notification to deliver to many devices. Every target
+// gets a copy of the payload with its account, token and environment set.
+type Batch struct {
+	Payload
+	Targets []Target `json:"targets"`
+}
+
+type Target struct {
+	AccountID   int64  `json:"account_id"`
+	DeviceToken string `json:"device_token"`
+	Environment string `json:"environment"`
+}
+
+type BatchSummary struct {
+	Dropped      int      `json:"dropped"`
+	Failed       int      `json:"failed"`
+	FailedTokens []string `json:"failed_tokens"`
+	Succeeded    int      `json:"succeeded"`
+}
+
+// Values accepted by APNS for the apns-push-type header.
+var PushTypes = map[string]bool{
+	"alert":        true,
+	"background":   true,
+	"complication": true,
+	"fileprovider": true,
+	"liveactivity": true,
+	"location":     true,
+	"mdm":          true,
+	"voip":         true,
+}
+
+const (
+	AuthCertificate = "certificate"
+	AuthToken       = "token"
+)
+
+// AppConfig describes how to connect to APNS on behalf of an app.
+type AppConfig struct {
+	App string `json:"app"`
+	// Auth is either AuthCertificate (the default), which uses secrets/<app>.pem
+	// and secrets/<app>.key, or AuthToken, which signs provider tokens with
+	// secrets/<app>.p8 using KeyID and TeamID.
+	Auth string `json:"auth"`
+	// Certificates lists the certificates to use in order of preference, as
+	// file names without the extension. Defaults to just App.
+	Certificates []string `json:"certificates"`
+	// Connections is how many HTTP/2 connections to spread pushes over. Each
+	// connection multiplexes up to the stream limit APNS advertises (currently
+	// 1000), and opens an extra connection when that runs out. The default of
+	// 1 is plenty for most apps; raise it for apps pushing thousands per second.
+	Connections int `json:"connections"`
+	// Environment forces every push for the app to "production" or
+	// "development", whatever the payload says, e.g. for internal test builds.
+	Environment string `json:"environment"`
+	KeyID       string `json:"key_id"`
+	// Sound is played for the app's alerts that don't specify one, instead of
+	// DEFAULT_SOUND.
+	Sound string `json:"sound"`
+	// Namespace is the datastore namespace the app's accounts and devices are
+	// stored in, for payloads that don't specify one.
+	Namespace string `json:"namespace"`
+	// MaxStreams caps how many requests to APNS the app has in flight at once,
+	// with pushes beyond that waiting for their turn. It defaults to
+	// StreamsPerConnection for each connection, which stops the HTTP/2 transport
+	// from opening more connections than configured.
+	MaxStreams int    `json:"max_streams"`
+	TeamID     string `json:"team_id"`
+	// Topic is the app's bundle ID, if it's different from App.
+	Topic string `json:"topic"`
+}
+
+type Client struct {
+	Config AppConfig
+
+	// Guards conns and signer, which are replaced when the client is reloaded.
+	mu          sync.RWMutex
+	conns       []*http.Client
+	signer      *TokenSigner
+	tls         *tls.Config
+	next        uint32
+	reconnected time.Time
+	// The certificates the app may use, when each of them expires, and which
+	// of them is in use.
+	certs    []tls.Certificate
+	expiries []time.Time
+	cert     int
+
+	statusMu sync.Mutex
+	status   AppStatus
+	breaker  Breaker
+	// Holds a value for every request in flight, up to Config.MaxStreams.
+	streams chan struct{}
+}
+
+// AppStatus is a summary of how an app's recent pushes went.
+type AppStatus struct {
+	Breaker string `json:"breaker"`
+	// Disabled is when an operator disabled the app, if they did.
+	Disabled *time.Time `json:"disabled,omitempty"`
+	// CertificateExpires is when the certificate in use expires, for apps
+	// using certificates, and CertificateExpiring is set when that's within
+	// CERT_EXPIRY_WARNING_DAYS.
+	CertificateExpires  *time.Time `json:"certificate_expires,omitempty"`
+	CertificateExpiring bool       `json:"certificate_expiring,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	LastError           *AppError  `json:"last_error,omitempty"`
+	LastSuccess         time.Time  `json:"last_success"`
+}
+
+type AppError struct {
+	Reason     string    `json:"reason"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Time       time.Time `json:"time"`
+}
+
+// Status returns a snapshot of the app's status.
+func (c *Client) Status() AppStatus {
+	c.statusMu.Lock()
+	status := c.status
+	c.statusMu.Unlock()
+	status.Breaker = c.breaker.State()
+	if expires := c.CertificateExpiry(); !expires.IsZero() {
+		status.CertificateExpires = &expires
+		status.CertificateExpiring = time.Until(expires) < certExpiryWarning
+	}
+	return status
+}
+
+// Records the outcome of a push in the app's status.
+func (c *Client) record(err error) {
+	now := time.Now()
+	c.statusMu.Lock()
+	defer c.statusMu.Unlock()
+	if err == nil {
+		c.status.ConsecutiveFailures = 0
+		c.status.LastSuccess = now
+		return
+	}
+	c.status.ConsecutiveFailures++
+	c.status.LastError = &AppError{Reason: err.Error(), Time: now}
+	if err, ok := err.(PushError); ok {
+		c.status.LastError.Reason = err.Reason
+		c.status.LastError.StatusCode = err.StatusCode
+	}
+}
+
+// Do sends the request on the next connection in turn.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	c.mu.RLock()
+	conns := c.conns
+	c.mu.RUnlock()
+	n := atomic.AddUint32(&c.next, 1)
+	return conns[n%uint32(len(conns))].Do(req)
+}
+
+// Signer returns the provider token signer, which is only set for apps using
+// token-based auth.
+func (c *Client) Signer() *TokenSigner {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.signer
+}
+
+// Reload reads the app's certificate or signing key again and switches new
+// pushes over to fresh connections. Pushes already in flight are unaffected.
+func (c *Client) Reload() error {
+	fresh, err := NewClient(c.Config)
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	old := c.conns
+	c.conns, c.signer, c.tls = fresh.conns, fresh.signer, fresh.tls
+	c.certs, c.expiries, c.cert = fresh.certs, fresh.expiries, fresh.cert
+	c.mu.Unlock()
+	retire(old)
+	return nil
+}
+
+// Close closes the client's connections. Requests that are still in flight
+// keep their connection until they are done.
+func (c *Client) Close() {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	retire(c.conns)
+}
+
+// Host returns the APNS host that most of the app's pushes go to, which is
+// the sandbox for apps forced into the development environment.
+func (c *Client) Host() string {
+	if c.Config.Environment == "development" {
+		return apnsHostDev
+	}
+	return apnsHost
+}
+
+// WarmUp makes a request to host on every connection, which establishes them.
+// The response itself doesn't matter.
+func (c *Client) WarmUp(ctx context.Context, host string) error {
+	c.mu.RLock()
+	conns := c.conns
+	c.mu.RUnlock()
+	for _, conn := range conns {
+		req, err := http.NewRequestWithContext(ctx, "HEAD", host, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := conn.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// CertificateExpiry returns when the certificate in use expires, or the zero
+// time if the app uses token auth.
+func (c *Client) CertificateExpiry() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	if c.cert >= len(c.expiries) {
+		return time.Time{}
+	}
+	return c.expiries[c.cert]
+}
+
+// Certificate returns the index of the certificate currently in use.
+func (c *Client) Certificate() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.cert
+}
+
+// FailOver switches to the next certificate after certificate from was
+// rejected, and reports whether it's worth trying again with the one now in
+// use. This is also the case if another push already switched certificates.
+func (c *Client) FailOver(from int) (bool, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.cert != from {
+		return true, nil
+	}
+	if from+1 >= len(c.certs) {
+		return false, nil
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{c.certs[from+1]}}
+	conns, err := newConns(c.Config.App, config, len(c.conns))
+	if err != nil {
+		return false, err
+	}
+	old := c.conns
+	c.conns, c.tls, c.cert = conns, config, from+1
+	retire(old)
+	return true, nil
+}
+
+// Reconnect replaces the client's connections with new ones, e.g. after APNS
+// sent a GOAWAY. It does nothing if the connections were replaced less than
+// ReconnectInterval ago, so that a burst of failures only reconnects once.
+func (c *Client) Reconnect() error {
+	c.mu.Lock()
+	if time.Since(c.reconnected) < ReconnectInterval {
+		c.mu.Unlock()
+		return nil
+	}
+	conns, err := newConns(c.Config.App, c.tls, len(c.conns))
+	if err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	old := c.conns
+	c.conns = conns
+	c.reconnected = time.Now()
+	c.mu.Unlock()
+	retire(old)
+	return nil
+}
+
+// ClientMap holds the client for every app, and is safe for concurrent use.
+type ClientMap struct {
+	mu      sync.RWMutex
+	clients map[string]*Client
+}
+
+func NewClientMap() *ClientMap {
+	return &ClientMap{clients: make(map[string]*Client)}
+}
 
-func (m ClientMap) Create(app string) *http.Client {
-	if _, ok := m[app]; ok {
+func (m *ClientMap) Create(config AppConfig) (*Client, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.clients[config.App]; ok {
 		panic("tried to overwrite existing client")
 	}
-	client := NewClient(app)
-	m[app] = client
-	return client
+	client, err := NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	m.clients[config.App] = client
+	return client, nil
+}
+
+func (m *ClientMap) Get(app string) (client *Client, ok bool) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	client, ok = m.clients[app]
+	return
+}
+
+// Replace swaps in a new client for an existing app.
+func (m *ClientMap) Replace(config AppConfig) (*Client, error) {
+	client, err := NewClient(config)
+	if err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.clients[config.App]; !ok {
+		return nil, fmt.Errorf("invalid app \"%s\"", config.App)
+	}
+	m.clients[config.App] = client
+	return client, nil
+}
+
+// Remove drops the client for an app, returning it so that its connections can
+// be closed once nothing is using them.
+func (m *ClientMap) Remove(app string) (client *Client, ok bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if client, ok = m.clients[app]; ok {
+		delete(m.clients, app)
+	}
+	return
+}
+
+// All returns a snapshot of the clients by app.
+func (m *ClientMap) All() map[string]*Client {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	all := make(map[string]*Client, len(m.clients))
+	for app, client := range m.clients {
+		all[app] = client
+	}
+	return all
 }
 
 var (
-	store     *datastore.Client
-	clients   = make(ClientMap)
+	store *datastore.Client
+	// The Google Cloud project for datastore, FCM and Secret Manager.
+	projectId = DefaultProjectId
+	clients   = NewClientMap()
 	ctx       = context.Background()
-	timestamp = time.Now()
+	// Background pushes run under this context, which is canceled if they don't
+	// finish in time during shutdown.
+	pushCtx, cancelPushes = context.WithCancel(context.Background())
+	// APNS hosts, which can be overridden to point at a mock server or proxy.
+	apnsHost    = AppleHost
+	apnsHostDev = AppleHostDev
+	// How long APNS gets to accept a connection, and to respond to a request.
+	connectTimeout = DefaultConnectTimeout
+	requestTimeout = DefaultRequestTimeout
+	// The longest line and body pushHandler accepts, in bytes.
+	maxLineSize = getenvInt("MAX_LINE_SIZE", DefaultMaxLineSize)
+	maxBodySize = int64(getenvInt("MAX_BODY_SIZE", DefaultMaxBodySize))
+	// The most payloads pushHandler takes from one request. The rest are
+	// ignored and reported as such.
+	maxLines = getenvInt("MAX_LINES", DefaultMaxLines)
+	// Payloads over this percentage of the APNS size limit are logged, or none
+	// if 0.
+	payloadWarnPercent = getenvInt("PAYLOAD_WARN_PERCENT", DefaultPayloadWarnPercent)
+	// Played for alerts that don't specify a sound, unless the app has its own.
+	defaultSound = os.Getenv("DEFAULT_SOUND")
+	// Whether priority 10 pushes without an alert are rejected instead of sent
+	// with priority 5.
+	rejectBadPriority, _ = strconv.ParseBool(os.Getenv("REJECT_BAD_PRIORITY"))
+	// Where certificates and signing keys are loaded from.
+	secretSource SecretSource = FileSource("secrets")
+	// Buffers device stats when batching is enabled, otherwise nil.
+	statsBuffer *StatsBuffer
+	// Counts push outcomes per app and day unless DAILY_COUNTS_FLUSH_INTERVAL
+	// is 0, otherwise nil.
+	dailyCounts *DailyCounters
+	// Devices are disabled after this many consecutive failures, or never if 0.
+	disableAfter int
+	// Whether undeliverable notifications are stored as FailedPush entities.
+	deadLetters, _ = strconv.ParseBool(os.Getenv("DEAD_LETTERS"))
+	// Drops repeated payloads when DEDUP_WINDOW is set, otherwise nil.
+	dedup *Dedup
+	// Limits pushes per device when RATE_LIMIT is set, otherwise nil.
+	rateLimiter *RateLimiter
+	// Receives delivery events when WEBHOOK_URL is set, otherwise nil.
+	webhook *Webhook
+	// Told about devices deleted for bad tokens when DEVICE_WEBHOOK_URL is set,
+	// otherwise nil.
+	deviceWebhook *Webhook
+	// Shared secret that callers must send as a bearer token.
+	secret = os.Getenv("PUSH_SECRET")
+	// Tracks pushes that are still in flight so that shutdown can wait for them.
+	pending sync.WaitGroup
+	// Payloads waiting for a worker, and whether the queue is currently full.
+	queue     chan job
+	saturated int32
+)
+
+const (
+	DefaultProjectId          = "roger-api"
+	AppleHost                 = "https://api.push.apple.com"
+	AppleHostDev              = "https://api.development.push.apple.com"
+	DefaultAppsPath           = "secrets/apps.json"
+	DefaultConnectTimeout     = 10 * time.Second
+	DefaultDisableAfter       = 0
+	DefaultExpiration         = 168 * time.Hour
+	DefaultPort               = "8080"
+	DefaultPushType           = "alert"
+	DefaultMaxBodySize        = 64 * 1024 * 1024
+	DefaultMaxLineSize        = 256 * 1024
+	DefaultMaxLines           = 100000
+	DefaultPayloadWarnPercent = 90
+	DefaultQueueSize          = 1000
+	DefaultRequestTimeout     = 3 * time.Second
+	DefaultWorkers            = 100
+	DefaultShutdownTimeout    = 20 * time.Second
+	DefaultStatsBatchSize     = 500
+	DefaultStatsFlushInterval = 5 * time.Second
+	DatastoreTimeout          = 2 * time.Second
+	MaxCollapseID             = 64
+	PlatformAndroid           = "android"
+)
+
+// APNS rejects payloads larger than this, except for VoIP pushes.
+const (
+	MaxPayloadSize     = 4096
+	MaxPayloadSizeVoIP = 5120
 )
 
+// Idle HTTP/2 connections are sent a PING every PingFrequency, and closed if
+// APNS doesn't respond within PingThreshold.
 const (
-	ProjectId     = "roger-api"
-	AppleHost     = "https://api.push.apple.com"
-	AppleHostDev  = "https://api.development.push.apple.com"
-	DefaultPort   = "8080"
-	MaxRetries    = 3
-	PingFrequency = time.Second
-	PingThreshold = time.Minute
+	PingFrequency = 30 * time.Second
+	PingThreshold = 15 * time.Second
 )
 
+// Connections are replaced at most this often after connection errors.
+const ReconnectInterval = 5 * time.Second
+
+// The number of concurrent streams APNS currently allows on a connection.
+const StreamsPerConnection = 1000
+
 func main() {
+	// Log JSON lines, including anything logged through the log package.
+	// Set LOG_LEVEL=debug to also log e.g. the timing of every request.
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(os.Getenv("LOG_LEVEL"))); err != nil && os.Getenv("LOG_LEVEL") != "" {
+		log.Fatalf("Invalid LOG_LEVEL: %v", err)
+	}
+	slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: level})))
+
 	// Set up the Datastore client.
 	var err error
-	store, err = datastore.NewClient(ctx, ProjectId)
+	if s := os.Getenv("GOOGLE_CLOUD_PROJECT"); s != "" {
+		projectId = s
+	}
+	store, err = datastore.NewClient(ctx, projectId)
 	if err != nil {
 		log.Fatalf("Failed to create Datastore client (datastore.NewClient: %v)", err)
 	}
 
 	// Set up the APNS clients.
-	clients.Create("cam.reaction.ReactionCam")
+	if s := os.Getenv("APNS_HOST"); s != "" {
+		apnsHost = s
+	}
+	if s := os.Getenv("APNS_HOST_DEV"); s != "" {
+		apnsHostDev = s
+	}
+	connectTimeout = getenvDuration("APNS_CONNECT_TIMEOUT", DefaultConnectTimeout)
+	requestTimeout = getenvDuration("APNS_TIMEOUT", DefaultRequestTimeout)
+	secretSource, err = NewSecretSource(ctx, os.Getenv("SECRETS_SOURCE"))
+	if err != nil {
+		log.Fatalf("Failed to set up secrets: %v", err)
+	}
+	appsPath := DefaultAppsPath
+	if s := os.Getenv("APPS_CONFIG"); s != "" {
+		appsPath = s
+	}
+	configs, err := LoadAppConfigs(appsPath)
+	if err != nil {
+		log.Fatalf("Failed to load app configs: %v", err)
+	}
+	for _, config := range configs {
+		if err := addClient(config); err != nil {
+			log.Printf("Skipping app %s: %v", config.App, err)
+			continue
+		}
+		log.Printf("Created client for %s", config.App)
+	}
+	for _, warning := range expiringCertificates() {
+		slog.Warn(warning, "event", "certificate_expiring")
+	}
+
+	// Set up the FCM client. Android pushes will fail without it.
+	fcmClient, err = NewFCMClient(ctx)
+	if err != nil {
+		log.Printf("Failed to create FCM client: %v", err)
+	}
+
+	// Set up Web Push signing. Web pushes will fail without it.
+	if key := os.Getenv("VAPID_PRIVATE_KEY"); key != "" {
+		if vapid, err = NewVAPIDSigner(key, os.Getenv("VAPID_SUBJECT")); err != nil {
+			log.Fatalf("Failed to set up web push: %v", err)
+		}
+	}
 
 	port := DefaultPort
 	if s := os.Getenv("PORT"); s != "" {
 		port = s
 	}
 
-	http.HandleFunc("/ping", pingHandler)
-	http.HandleFunc("/v1/push", pushHandler)
+	// Batch device stats writes in the background unless the flush interval is
+	// set to 0, so that pushes don't wait on (or fail with) datastore.
+	if interval := getenvDuration("STATS_FLUSH_INTERVAL", DefaultStatsFlushInterval); interval > 0 {
+		statsBuffer = NewStatsBuffer(getenvInt("STATS_BATCH_SIZE", DefaultStatsBatchSize))
+		go statsBuffer.Run(interval)
+	}
+	if interval := getenvDuration("DAILY_COUNTS_FLUSH_INTERVAL", DefaultDailyCountsFlushInterval); interval > 0 {
+		dailyCounts = NewDailyCounters()
+		go dailyCounts.Run(interval)
+	}
 
-	go pinger()
+	if secret == "" {
+		log.Printf("PUSH_SECRET is not set, the push endpoint is unauthenticated and the admin endpoints are disabled!")
+	}
 
-	// Set up the server.
-	log.Printf("Serving on %s...", port)
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.Fatalf("http.ListenAndServe: %v", err)
+	retryPolicy = LoadRetryPolicy("", retryPolicy)
+	importantRetryPolicy = LoadRetryPolicy("IMPORTANT_", importantRetryPolicy)
+	if n := getenvInt("RETRY_CONCURRENCY", DefaultRetryConcurrency); n > 0 {
+		retrySlots = make(chan struct{}, n)
 	}
-}
+	breakerCooldown = getenvDuration("BREAKER_COOLDOWN", DefaultBreakerCooldown)
+	breakerMinRequests = getenvInt("BREAKER_MIN_REQUESTS", DefaultBreakerMinRequests)
+	breakerThreshold = getenvInt("BREAKER_THRESHOLD", DefaultBreakerThreshold)
+	if window := getenvDuration("DEDUP_WINDOW", 0); window > 0 {
+		dedup = NewDedup(window)
+	}
+	if ttl := getenvDuration("IDEMPOTENCY_TTL", DefaultIdempotencyTTL); ttl > 0 {
+		idempotency = NewIdempotency(ttl)
+	}
+	if perMinute := getenvInt("RATE_LIMIT", 0); perMinute > 0 {
+		rateLimiter = NewRateLimiter(perMinute)
+	}
+	if url := os.Getenv("WEBHOOK_URL"); url != "" {
+		webhook = NewWebhook(url, os.Getenv("WEBHOOK_SECRET"))
+	}
+	if url := os.Getenv("DEVICE_WEBHOOK_URL"); url != "" {
+		deviceWebhook = NewWebhook(url, os.Getenv("WEBHOOK_SECRET"))
+	}
+	disableAfter = getenvInt("DISABLE_AFTER_FAILURES", DefaultDisableAfter)
 
-func NewClient(app string) *http.Client {
-	cert, err := tls.LoadX509KeyPair(
-		fmt.Sprintf("secrets/%s.pem", app),
-		fmt.Sprintf("secrets/%s.key", app))
-	if err != nil {
-		log.Fatalf("Failed to create client for %s: %v", app, err)
+	// Set up the push workers.
+	queue = make(chan job, getenvInt("QUEUE_SIZE", DefaultQueueSize))
+	workers := getenvInt("WORKERS", DefaultWorkers)
+	for i := 0; i < workers; i++ {
+		go worker()
 	}
-	config := &tls.Config{
-		Certificates: []tls.Certificate{cert},
+
+	http.Handle("/metrics", promhttp.Handler())
+	http.HandleFunc("/ping", pingHandler)
+	http.HandleFunc("/ready", readyHandler)
+	http.HandleFunc("/v1/push", requireAuth(idempotent(pushHandler)))
+	http.HandleFunc("/v1/push/batch", requireAuth(idempotent(batchHandler)))
+	http.HandleFunc("/v1/push/status", requireSecret(deviceStatusHandler))
+	http.HandleFunc("/v1/device/delete", requireSecret(deleteDeviceHandler))
+	http.HandleFunc("/admin/status", requireSecret(statusHandler))
+	http.HandleFunc("/admin/disable", requireSecret(disableAppHandler))
+	http.HandleFunc("/admin/replay", requireSecret(replayHandler))
+	http.HandleFunc("/admin/test-push", requireSecret(testPushHandler))
+
+	// Set up the server.
+	server := &http.Server{Addr: ":" + port}
+	go func() {
+		log.Printf("Serving on %s...", port)
+		if err := server.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("http.ListenAndServe: %v", err)
+		}
+	}()
+
+	// Reload the app configs and certificates on SIGHUP, e.g. after adding an
+	// app or rotating certificates.
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	go func() {
+		for range hangups {
+			reloadApps(appsPath)
+		}
+	}()
+
+	// Stop accepting requests on SIGINT/SIGTERM and let in-flight pushes finish.
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	log.Printf("Received %s, shutting down...", <-signals)
+	timeout := getenvDuration("SHUTDOWN_TIMEOUT", DefaultShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Printf("Failed to shut down server gracefully: %v", err)
 	}
-	config.BuildNameToCertificate()
-	transport := &http.Transport{
-		TLSClientConfig: config,
+	drained := make(chan struct{})
+	go func() {
+		pending.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+		log.Printf("All pushes finished")
+	case <-shutdownCtx.Done():
+		log.Printf("Gave up waiting for in-flight pushes after %s", timeout)
+		cancelPushes()
 	}
-	// Explicitly enable HTTP/2 as TLS-configured clients don't auto-upgrade.
-	// See: https://github.com/golang/go/issues/14275
-	if err := http2.ConfigureTransport(transport); err != nil {
-		log.Fatalf("Failed to configure HTTP/2 for %s client: %v", app, err)
+	if dailyCounts != nil {
+		dailyCounts.Flush()
 	}
-	return &http.Client{
-		Timeout:   3 * time.Second,
-		Transport: transport,
+	if statsBuffer != nil {
+		statsBuffer.Flush()
 	}
 }
 
-func Push(app, deviceToken, env string, data json.RawMessage) (err error) {
-	client, ok := clients[app]
-	if !ok {
-		err = fmt.Errorf("invalid app \"%s\"", app)
-		return
+// LoadAppConfigs reads the list of apps from the JSON file at path. If there is
+// no such file, every certificate in secrets/ is treated as an app. Listing an
+// app more than once is an error.
+func LoadAppConfigs(path string) ([]AppConfig, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		certs, err := filepath.Glob("secrets/*.pem")
+		if err != nil {
+			return nil, err
+		}
+		var configs []AppConfig
+		for _, cert := range certs {
+			app := strings.TrimSuffix(filepath.Base(cert), ".pem")
+			configs = append(configs, AppConfig{App: app})
+		}
+		return configs, nil
+	} else if err != nil {
+		return nil, err
 	}
-	var url string
-	if env == "development" {
-		url = fmt.Sprintf("%s/3/device/%s", AppleHostDev, deviceToken)
-	} else {
-		url = fmt.Sprintf("%s/3/device/%s", AppleHost, deviceToken)
+	var configs []AppConfig
+	if err := json.Unmarshal(data, &configs); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
 	}
-	req, err := http.NewRequest("POST", url, bytes.NewReader(data))
+	seen := make(map[string]bool)
+	for _, config := range configs {
+		if seen[config.App] {
+			return nil, fmt.Errorf("%s: app %s is listed more than once", path, config.App)
+		}
+		seen[config.App] = true
+	}
+	return configs, nil
+}
+
+// Creates the client for an app and connects it in the background, so that the
+// first push doesn't pay for the handshake.
+func addClient(config AppConfig) error {
+	client, err := clients.Create(config)
 	if err != nil {
-		return
+		return err
 	}
-	expiration := time.Now().Add(168 * time.Hour).Unix()
-	req.Header.Set("apns-expiration", strconv.FormatInt(expiration, 10))
-	req.Header.Set("apns-topic", app)
-	req.Header.Set("Content-Type", "application/json")
-	resp, err := client.Do(req)
+	go func() {
+		if err := client.WarmUp(ctx, client.Host()); err != nil {
+			log.Printf("Failed to warm up %s: %v", config.App, err)
+		}
+	}()
+	return nil
+}
+
+// Brings the clients in line with the app configs at path. New apps get a
+// client, removed apps lose theirs, apps whose config changed get a new client
+// and the rest reload their certificates. Pushes already holding a client
+// finish with it. If the configs can't be loaded, nothing changes.
+func reloadApps(path string) {
+	configs, err := LoadAppConfigs(path)
 	if err != nil {
+		log.Printf("Failed to reload app configs: %v", err)
 		return
 	}
-	defer resp.Body.Close()
-	timestamp = time.Now()
-	if resp.StatusCode == http.StatusOK {
-		return nil
+	existing := clients.All()
+	for _, config := range configs {
+		client, ok := existing[config.App]
+		delete(existing, config.App)
+		if !ok {
+			if err := addClient(config); err != nil {
+				log.Printf("Failed to add %s: %v", config.App, err)
+			} else {
+				log.Printf("Added %s", config.App)
+			}
+			continue
+		}
+		if reflect.DeepEqual(client.Config, config) {
+			if err := client.Reload(); err != nil {
+				log.Printf("Failed to reload %s: %v", config.App, err)
+			} else {
+				log.Printf("Reloaded %s", config.App)
+			}
+			continue
+		}
+		if _, err := clients.Replace(config); err != nil {
+			log.Printf("Failed to update %s: %v", config.App, err)
+			continue
+		}
+		client.Close()
+		log.Printf("Updated %s", config.App)
 	}
-	// Something went wrong – get the error from body.
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return
+	// Whatever is left is no longer configured.
+	for app := range existing {
+		if client, ok := clients.Remove(app); ok {
+			client.Close()
+			log.Printf("Removed %s", app)
+		}
 	}
-	return PushError{Body: body, StatusCode: resp.StatusCode}
 }
 
-func pinger() {
-	// TODO: Figure out how to ping connections instead of closing.
-	for {
-		if time.Since(timestamp) > PingThreshold {
-			timestamp = time.Now()
-			for app := range clients {
-				clients[app] = NewClient(app)
+func NewClient(appConfig AppConfig) (*Client, error) {
+	app := appConfig.App
+	client := &Client{Config: appConfig}
+	config := &tls.Config{}
+	switch appConfig.Auth {
+	case "", AuthCertificate:
+		names := appConfig.Certificates
+		if len(names) == 0 {
+			names = []string{app}
+		}
+		for _, name := range names {
+			certPEM, err := secretSource.Read(name + ".pem")
+			if err != nil {
+				return nil, err
+			}
+			keyPEM, err := secretSource.Read(name + ".key")
+			if err != nil {
+				return nil, err
+			}
+			cert, err := tls.X509KeyPair(certPEM, keyPEM)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
 			}
+			leaf, err := x509.ParseCertificate(cert.Certificate[0])
+			if err != nil {
+				return nil, fmt.Errorf("%s: %v", name, err)
+			}
+			client.certs = append(client.certs, cert)
+			client.expiries = append(client.expiries, leaf.NotAfter)
+		}
+		config.Certificates = client.certs[:1]
+	case AuthToken:
+		key, err := secretSource.Read(app + ".p8")
+		if err != nil {
+			return nil, err
 		}
-		time.Sleep(PingFrequency)
+		signer, err := NewTokenSigner(key, appConfig.KeyID, appConfig.TeamID)
+		if err != nil {
+			return nil, err
+		}
+		client.signer = signer
+	default:
+		return nil, fmt.Errorf("unknown auth \"%s\"", appConfig.Auth)
+	}
+	connections := appConfig.Connections
+	if connections < 1 {
+		connections = 1
 	}
+	conns, err := newConns(app, config, connections)
+	if err != nil {
+		return nil, err
+	}
+	client.conns = conns
+	client.tls = config
+	streams := appConfig.MaxStreams
+	if streams < 1 {
+		streams = connections * StreamsPerConnection
+	}
+	client.streams = make(chan struct{}, streams)
+	return client, nil
 }
 
-// Push with retry.
-func push(payload Payload) {
-	app := payload.App
-	if app == "" {
-		log.Printf("Unrecognized app %#v", app)
-		return
-	}
-	accountKey := datastore.IDKey("Account", payload.AccountID, nil)
-	deviceKey := datastore.NameKey("Device", payload.DeviceToken, accountKey)
-	attempt := 1
-	for {
-		err := Push(app, payload.DeviceToken, payload.Environment, payload.Data)
-		if err, ok := err.(PushError); ok && err.Permanent() {
-			if err.Permanent() {
-				log.Printf("[%d] PERMANENT FAILURE: %s", payload.AccountID, err)
-				if err := store.Delete(ctx, deviceKey); err != nil {
-					log.Printf("[%d] FAILED TO DELETE TOKEN: %v", payload.AccountID, err)
-				}
-			} else if !err.Retryable() {
-				log.Printf("[%d] DROPPING NOTIFICATION: %s", payload.AccountID, err)
-			}
-			log.Printf("[%d] %s", payload.AccountID, string(payload.Data))
-			return
+// Sets up n HTTP/2 connections to APNS. Every connection gets its own
+// transport, since a transport would otherwise reuse a single connection for as
+// long as it has streams available.
+func newConns(app string, config *tls.Config, n int) (conns []*http.Client, err error) {
+	dialer := &net.Dialer{Timeout: connectTimeout}
+	dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
 		}
-		if updateErr := updateDeviceStats(ctx, deviceKey, err == nil); updateErr != nil {
-			log.Printf("[%d] FAILED TO UPDATE TOKEN: %v", payload.AccountID, updateErr)
-		}
-		if err == nil {
-			return
+		connectionsOpened.WithLabelValues(app).Inc()
+		connectionsActive.WithLabelValues(app).Inc()
+		return &countedConn{Conn: conn, app: app}, nil
+	}
+	for i := 0; i < n; i++ {
+		transport := &http.Transport{
+			DialContext:         dial,
+			TLSClientConfig:     config,
+			TLSHandshakeTimeout: connectTimeout,
 		}
-		// An error occurred.
-		log.Printf("[%d] Failed to push (attempt %d/%d): %s", payload.AccountID, attempt, MaxRetries, err)
-		// Exponential backoff.
-		if attempt >= MaxRetries {
-			log.Printf("[%d] DROPPING NOTIFICATION: exceeded max retries", payload.AccountID)
-			log.Printf("[%d] %s", payload.AccountID, string(payload.Data))
-			return
+		// Explicitly enable HTTP/2 as TLS-configured clients don't auto-upgrade.
+		// See: https://github.com/golang/go/issues/14275
+		h2, err := http2.ConfigureTransports(transport)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure HTTP/2: %v", err)
 		}
-		time.Sleep(time.Duration(math.Exp2(float64(attempt-1))) * time.Second)
-		attempt += 1
+		// Keep connections warm with PING frames rather than letting them go stale.
+		h2.ReadIdleTimeout = PingFrequency
+		h2.PingTimeout = PingThreshold
+		conns = append(conns, &http.Client{
+			Timeout:   requestTimeout,
+			Transport: transport,
+		})
 	}
+	return conns, nil
 }
 
-func updateDeviceStats(ctx context.Context, key *datastore.Key, success bool) error {
-	_, err := store.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
-		var device Device
-		if err := tx.Get(key, &device); err != nil {
-			return err
-		}
-		now := time.Now()
-		device.Updated = now
-		if success {
-			device.LastSuccess = now
-			device.TotalSuccesses += 1
-			device.Failures = 0
-		} else {
-			device.Failures += 1
-			device.TotalFailures += 1
+// Closes connections that have been replaced. Idle ones are closed right away,
+// and the rest once the requests using them are done, which they are after
+// requestTimeout at the latest. Otherwise PINGs would keep them open forever.
+func retire(conns []*http.Client) {
+	closeIdle := func() {
+		for _, conn := range conns {
+			conn.CloseIdleConnections()
 		}
-		_, err := tx.Put(key, &device)
-		return err
-	})
-	return err
+	}
+	closeIdle()
+	time.AfterFunc(requestTimeout+time.Second, closeIdle)
 }
 
-func pingHandler(w http.ResponseWriter, r *http.Request) {
-	w.WriteHeader(200)
-	fmt.Fprintln(w, "ok")
+// Keeps the connection metrics up to date when the connection closes.
+type countedConn struct {
+	net.Conn
+	app    string
+	closed sync.Once
 }
 
-func pushHandler(w http.ResponseWriter, r *http.Request) {
-	scanner := bufio.NewScanner(r.Body)
-	for scanner.Scan() {
-		var payload Payload
-		if err := json.Unmarshal(scanner.Bytes(), &payload); err != nil {
-			log.Printf("Failed to parse JSON: %s | %s", err, scanner.Text())
-			continue
-		}
-		go push(payload)
+func (c *countedConn) Close() error {
+	c.closed.Do(func() {
+		connectionsClosed.WithLabelValues(c.app).Inc()
+		connectionsActive.WithLabelValues(c.app).Dec()
+	})
+	return c.Conn.Close()
+}
+
+// NewPushRequest validates the payload and builds the APNS request for it.
+func NewPushRequest(ctx context.Context, payload Payload) (client *Client, req *http.Request, err error) {
+	app := payload.App
+	client, ok := clients.Get(app)
+	if !ok {
+		err = UnknownAppError{App: app}
+		return
 	}
-	if err := scanner.Err(); err != nil {
-		log.Printf("Failed to read data: %s", err)
+	if len(payload.CollapseID) > MaxCollapseID {
+		err = PayloadError{Reason: fmt.Sprintf("collapse_id exceeds %d bytes", MaxCollapseID)}
+		return
+	}
+	if payload.LiveActivity != nil {
+		if payload.PushType != "" && payload.PushType != "liveactivity" {
+			err = PayloadError{Reason: fmt.Sprintf("live activities can't have push_type \"%s\"", payload.PushType)}
+			return
+		}
+		payload.PushType = "liveactivity"
+	}
+	priority := payload.Priority
+	if priority != 0 && priority != 5 && priority != 10 {
+		err = PayloadError{Reason: fmt.Sprintf("priority must be 5 or 10, got %d", priority)}
+		return
+	}
+	topic := app
+	if client.Config.Topic != "" {
+		topic = client.Config.Topic
+	}
+	if payload.Topic != "" {
+		if !strings.HasPrefix(payload.Topic, topic+".") || strings.ContainsAny(payload.Topic, " \t\r\n") {
+			err = PayloadError{Reason: fmt.Sprintf("topic \"%s\" is not valid for app %s", payload.Topic, app)}
+			return
+		}
+		topic = payload.Topic
+	} else if payload.PushType == "liveactivity" {
+		topic += TopicSuffixLiveActivity
+	}
+	pushType := payload.PushType
+	if pushType == "" {
+		pushType = DefaultPushType
+	} else if !PushTypes[pushType] {
+		err = PayloadError{Reason: fmt.Sprintf("unknown push_type \"%s\"", pushType)}
+		return
+	}
+	if payload.Silent {
+		// iOS throttles or drops silent pushes sent any other way.
+		if payload.PushType != "" && pushType != "background" {
+			err = PayloadError{Reason: fmt.Sprintf("silent pushes can't have push_type \"%s\"", pushType)}
+			return
+		}
+		if priority == 10 {
+			err = PayloadError{Reason: "silent pushes must have priority 5"}
+			return
+		}
+		pushType = "background"
+		priority = 5
+	}
+	// APNS would otherwise send background pushes with priority 10, which it
+	// doesn't allow for them.
+	if pushType == "background" && priority == 0 {
+		priority = 5
+	}
+	if payload.ID != "" && !ValidUUID(payload.ID) {
+		err = PayloadError{Reason: fmt.Sprintf("id \"%s\" is not a UUID", payload.ID)}
+		return
+	}
+	if payload.MutableContent && pushType != "alert" {
+		err = PayloadError{Reason: fmt.Sprintf("mutable_content requires push_type \"alert\", got \"%s\"", pushType)}
+		return
+	}
+	environment := payload.Environment
+	if client.Config.Environment != "" {
+		environment = client.Config.Environment
+	}
+	var url string
+	if environment == "development" {
+		url = fmt.Sprintf("%s/3/device/%s", apnsHostDev, payload.DeviceToken)
+	} else {
+		url = fmt.Sprintf("%s/3/device/%s", apnsHost, payload.DeviceToken)
+	}
+	sound := defaultSound
+	if client.Config.Sound != "" {
+		sound = client.Config.Sound
+	}
+	if pushType == "alert" {
+		if sound = payload.defaultSound(sound); sound != "" {
+			payload.Sound = sound
+		}
+	}
+	data, err := payload.APNSData()
+	if err != nil {
+		return
+	}
+	// Apple throttles apps that send priority 10 alert pushes that don't alert,
+	// which is also what pushes without a priority are sent as.
+	// This comes before checking the combination, which would reject the ones
+	// with only content-available even though they can be downgraded.
+	if (priority == 0 || priority == 10) && pushType == "alert" && !alertsUser(data) {
+		if rejectBadPriority {
+			err = PayloadError{Reason: "priority 10 requires an alert, badge or sound"}
+			return
+		}
+		slog.Info("Lowering priority of push without an alert", "event", "priority_downgraded", "app", app)
+		priority = 5
+	}
+	if err = checkCombination(pushType, priority, data); err != nil {
+		return
+	}
+	req, err = http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(data))
+	if err != nil {
+		return
+	}
+	expiration := time.Now().Add(DefaultExpiration).Unix()
+	if payload.Expiration != nil {
+		expiration = *payload.Expiration
+	}
+	if payload.Immediate {
+		if expiration != 0 && payload.Expiration != nil {
+			err = PayloadError{Reason: "immediate can't be combined with an expiration"}
+			return
+		}
+		expiration = 0
+	}
+	req.Header.Set("apns-expiration", strconv.FormatInt(expiration, 10))
+	if payload.ID != "" {
+		req.Header.Set("apns-id", payload.ID)
+	}
+	req.Header.Set("apns-push-type", pushType)
+	req.Header.Set("apns-topic", topic)
+	if payload.CollapseID != "" {
+		req.Header.Set("apns-collapse-id", payload.CollapseID)
+	}
+	if priority != 0 {
+		req.Header.Set("apns-priority", strconv.Itoa(priority))
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if signer := client.Signer(); signer != nil {
+		var token string
+		if token, err = signer.Token(); err != nil {
+			return
+		}
+		req.Header.Set("authorization", "bearer "+token)
+	}
+	return
+}
+
+// Push sends a single notification to APNS and returns the apns-id it was
+// assigned, and how long APNS took to respond.
+func Push(ctx context.Context, payload Payload) (apnsID string, latency time.Duration, err error) {
+	built := time.Now()
+	client, req, err := NewPushRequest(ctx, payload)
+	buildTime := time.Since(built)
+	if err != nil {
+		return
+	}
+	buildLatency.With(labels(payload)).Observe(buildTime.Seconds())
+	// Wait for a stream to free up rather than opening more than APNS allows.
+	// This happens before asking the breaker, so that giving up on the wait
+	// can't leave a half-open breaker waiting on a probe that never happens.
+	waitStart := time.Now()
+	select {
+	case client.streams <- struct{}{}:
+	case <-ctx.Done():
+		err = ctx.Err()
+		return
+	}
+	streamWait.With(labels(payload)).Observe(time.Since(waitStart).Seconds())
+	if !client.breaker.Allow() {
+		<-client.streams
+		err = CircuitOpenError{App: payload.App}
+		return
+	}
+	defer func() {
+		client.record(err)
+	}()
+	cert := client.Certificate()
+	streamsInUse.WithLabelValues(payload.App).Inc()
+	start := time.Now()
+	resp, err := client.Do(req)
+	networkTime := time.Since(start)
+	latency = networkTime
+	<-client.streams
+	streamsInUse.WithLabelValues(payload.App).Dec()
+	apnsLatency.With(labels(payload)).Observe(networkTime.Seconds())
+	client.breaker.Record(err != nil || resp.StatusCode >= 500)
+	slog.Debug("Sent request", "event", "request_timing", "app", payload.App,
+		"build_ms", float64(buildTime)/float64(time.Millisecond),
+		"network_ms", float64(networkTime)/float64(time.Millisecond))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	apnsID = resp.Header.Get("apns-id")
+	if resp.StatusCode == http.StatusOK {
+		return
+	}
+	// Something went wrong – get the error from body.
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	var reason struct {
+		Reason string `json:"reason"`
+		// Milliseconds since the epoch.
+		Timestamp int64 `json:"timestamp"`
+	}
+	json.Unmarshal(body, &reason)
+	pe := PushError{
+		ApnsID:     apnsID,
+		Body:       body,
+		Reason:     reason.Reason,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		StatusCode: resp.StatusCode,
+	}
+	if reason.Timestamp > 0 {
+		pe.Timestamp = time.UnixMilli(reason.Timestamp)
+	}
+	if pe.Reason == "ExpiredProviderToken" && client.Signer() != nil {
+		// Sign a new token for the retry, unless another push already did.
+		client.Signer().Reset(strings.TrimPrefix(req.Header.Get("authorization"), "bearer "))
+	}
+	if pe.CertificateProblem() {
+		// During rotation, fall back to the next certificate the app has.
+		if retry, err := client.FailOver(cert); err != nil {
+			slog.Error("Failed to switch certificates", "event", "certificate_failover_failed", "app", payload.App, "error", err)
+		} else if retry {
+			slog.Warn("Certificate rejected, switching to the next one", "event", "certificate_failover", "app", payload.App, "reason", pe.Reason)
+			return Push(ctx, payload)
+		}
+	}
+	err = pe
+	return
+}
+
+// Parses a Retry-After header, which is either a number of seconds or an HTTP
+// date. Returns zero if the header is missing or invalid.
+func parseRetryAfter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0
+		}
+		return time.Duration(seconds) * time.Second
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if d := time.Until(t); d > 0 {
+			return d
+		}
+	}
+	return 0
+}
+
+type job struct {
+	ctx     context.Context
+	payload Payload
+	done    func(Result)
+}
+
+// Queues the payload to be pushed by a worker, calling done (if set) with the
+// result. Blocks while the queue is full.
+func enqueue(ctx context.Context, payload Payload, done func(Result)) {
+	pending.Add(1)
+	j := job{ctx, payload, done}
+	select {
+	case queue <- j:
+		atomic.StoreInt32(&saturated, 0)
+	default:
+		if atomic.CompareAndSwapInt32(&saturated, 0, 1) {
+			slog.Warn("Push queue is full, consider raising WORKERS", "event", "queue_saturated", "queue_size", cap(queue))
+		}
+		queue <- j
+	}
+}
+
+func worker() {
+	for j := range queue {
+		pushesInFlight.Inc()
+		result := push(j.ctx, j.payload)
+		pushesInFlight.Dec()
+		if j.done != nil {
+			j.done(result)
+		}
+		pending.Done()
+	}
+}
+
+// Push with retry.
+func push(ctx context.Context, payload Payload) (result Result) {
+	app := payload.App
+	logger := slog.With("account_id", payload.AccountID, "app", app)
+	// Every outcome is reported, including pushes dropped before being sent.
+	if webhook != nil && !payload.DryRun {
+		start := time.Now()
+		defer func() {
+			webhook.Send(NewDeliveryEvent(payload, result, time.Since(start)))
+		}()
+	}
+	if app == "" {
+		logger.Warn("Unrecognized app", "event", "unrecognized_app")
+		return Result{Code: CodeUnknownApp, Error: "missing app"}
+	}
+	if dedup != nil && !payload.DryRun {
+		key := DedupKey(payload)
+		if dedup.Seen(key) {
+			logger.Info("Dropping duplicate notification", "event", "duplicate")
+			return Result{Code: CodeDuplicate, Error: "duplicate notification"}
+		}
+		// Only pushes that made it count, so that resends of the others go out.
+		defer func() {
+			if !result.Success {
+				dedup.Forget(key)
+			}
+		}()
+	}
+	if rateLimiter != nil && !payload.DryRun && !rateLimiter.Allow(payload.DeviceToken) {
+		logger.Warn("Dropping notification to rate limited device", "event", "rate_limited")
+		droppedTotal.With(labels(payload)).Inc()
+		return Result{Code: CodeRateLimited, Error: "rate limited"}
+	}
+	deviceKey := DeviceKey(payload.DeviceToken, payload.AccountKey())
+	platform := payload.Platform
+	autoEnvironment := payload.Environment == "auto"
+	// Whether the platform came from the payload or the device, rather than
+	// being assumed to be APNS because the lookup failed.
+	platformKnown := platform != ""
+	if platform == "" || payload.Environment == "" || autoEnvironment || disableAfter > 0 {
+		var device Device
+		// Push without the device rather than waiting on datastore if it's down.
+		lookupCtx, cancel := context.WithTimeout(ctx, DatastoreTimeout)
+		err := store.Get(lookupCtx, deviceKey, &device)
+		cancel()
+		if err == nil {
+			platformKnown = true
+			if !device.Disabled.IsZero() {
+				logger.Info("Skipping disabled device", "event", "device_disabled", "disabled", device.Disabled)
+				return Result{Code: CodeDeviceDisabled, Error: "device is disabled", Permanent: true}
+			}
+			if platform == "" {
+				platform = device.Platform
+			}
+			// Send to the environment the token was registered in, unless told otherwise.
+			if payload.Environment == "" || autoEnvironment {
+				payload.Environment = device.Environment
+			}
+		} else if err != datastore.ErrNoSuchEntity {
+			datastoreErrors.Error(logger, "Failed to look up device", "event", "device_lookup_failed", "error", err)
+		}
+	}
+	if autoEnvironment && payload.Environment == "auto" {
+		payload.Environment = "production"
+	}
+	if client, ok := clients.Get(app); ok && platform != PlatformAndroid && platform != PlatformWeb {
+		if env := client.Config.Environment; env != "" && env != payload.Environment {
+			logger.Info("Overriding environment for app", "event", "environment_override",
+				"requested", payload.Environment, "environment", env)
+			payload.Environment = env
+			autoEnvironment = false
+		}
+	}
+	if platform != PlatformAndroid && platform != PlatformWeb {
+		if token := NormalizeAPNSToken(payload.DeviceToken); token != payload.DeviceToken {
+			logger.Warn("Normalized device token", "event", "token_normalized",
+				"device_token", payload.DeviceToken, "normalized", token)
+			newKey := DeviceKey(token, deviceKey.Parent)
+			if !payload.DryRun {
+				newKey = moveDevice(ctx, logger, deviceKey, newKey)
+			}
+			deviceKey, payload.DeviceToken = newKey, token
+		}
+	}
+	logger = logger.With("environment", payload.Environment)
+	if dailyCounts != nil && !payload.DryRun {
+		defer func() {
+			dailyCounts.Add(payload, result)
+		}()
+	}
+	if deadLetters && !payload.DryRun && !payload.replay {
+		defer func() {
+			if !result.Success {
+				deadLetter(context.WithoutCancel(ctx), logger, payload, result.Error)
+			}
+		}()
+	}
+	metricLabels := labels(payload)
+	if !payload.DryRun {
+		pushesTotal.With(metricLabels).Inc()
+	}
+	if disabledApps.Disabled(app) {
+		logger.Warn("Dropping notification for disabled app", "event", "dropped",
+			"data", string(payload.Data))
+		droppedTotal.With(metricLabels).Inc()
+		return Result{Code: CodeAppDisabled, Error: "app is disabled"}
+	}
+	if err := validate(logger, payload, platform); err != nil {
+		logger.Warn("Dropping notification", append(errorAttrs(err), "event", "invalid_payload")...)
+		if !payload.DryRun {
+			permanentFailuresTotal.With(metricLabels).Inc()
+			// Don't delete what may be a perfectly good FCM or Web Push token
+			// just because it isn't a valid APNS one.
+			if err, ok := err.(PayloadError); ok && err.BadToken && platformKnown {
+				deleteDevice(ctx, logger, deviceKey)
+			}
+		}
+		return NewResult("", err)
+	}
+	if payload.DryRun {
+		return dryRun(ctx, payload, platform)
+	}
+	send := Push
+	switch platform {
+	case PlatformAndroid:
+		send = PushFCM
+	case PlatformWeb:
+		send = PushWeb
+	}
+	policy, dropLevel := retryPolicy, slog.LevelWarn
+	if payload.Important {
+		policy, dropLevel = importantRetryPolicy, slog.LevelError
+	}
+	attempt := 1
+	var (
+		retrying bool
+		switched bool
+		waited   time.Duration
+	)
+	defer func() {
+		if retrying {
+			releaseRetry()
+		}
+	}()
+	for {
+		logger := logger.With("attempt", attempt)
+		id, latency, err := send(ctx, payload)
+		if err, ok := err.(PayloadError); ok {
+			logger.Warn("Dropping notification", append(errorAttrs(err),
+				"event", "dropped",
+				"data", string(payload.Data))...)
+			droppedTotal.With(metricLabels).Inc()
+			return NewResult(id, err)
+		}
+		if err, ok := err.(UnknownAppError); ok {
+			// The app may have been removed by a reload, which retrying won't undo.
+			logger.Warn("Unrecognized app", append(errorAttrs(err), "event", "unrecognized_app")...)
+			droppedTotal.With(metricLabels).Inc()
+			return NewResult(id, err)
+		}
+		if err, ok := err.(CircuitOpenError); ok {
+			// Nothing was sent, and the breaker stays open for longer than the
+			// retries would take, so there's no point in keeping at it.
+			logger.Log(ctx, dropLevel, "Dropping notification: circuit breaker is open", append(errorAttrs(err),
+				"event", "dropped",
+				"data", string(payload.Data))...)
+			droppedTotal.With(metricLabels).Inc()
+			return NewResult(id, err)
+		}
+		if err, ok := err.(PushError); ok && autoEnvironment && !switched && wrongEnvironment(err) {
+			// The token may have been labeled with the wrong environment upstream,
+			// so give the other one a try before giving up on it.
+			from := payload.Environment
+			payload.Environment = "development"
+			if from == "development" {
+				payload.Environment = "production"
+			}
+			logger.Info("Retrying in the other environment", append(errorAttrs(err),
+				"event", "environment_retry",
+				"from", from,
+				"to", payload.Environment)...)
+			logger = logger.With("environment", payload.Environment)
+			switched = true
+			continue
+		}
+		if err, ok := err.(PushError); ok && err.Permanent() {
+			permanentFailuresTotal.With(metricLabels).Inc()
+			if err.CertificateProblem() {
+				// Every push for this app will fail until its credentials are fixed.
+				logger.Error(fmt.Sprintf("Certificate problem for app %s", app), append(errorAttrs(err),
+					"event", "certificate_problem",
+					"data", string(payload.Data))...)
+			} else if err.BadToken() {
+				// The token is no longer valid, so stop pushing to it.
+				logger.Warn("Permanent failure", append(errorAttrs(err),
+					"event", "permanent_failure",
+					"data", string(payload.Data))...)
+				if err.Timestamp.IsZero() {
+					deleteDevice(ctx, logger, deviceKey)
+				} else {
+					deleteUnregistered(ctx, logger, deviceKey, err.Timestamp)
+				}
+			} else {
+				// Something is wrong with the notification, not the token.
+				logger.Warn("Dropping notification", append(errorAttrs(err),
+					"event", "rejected",
+					"data", string(payload.Data))...)
+			}
+			return NewResult(id, err)
+		}
+		stats := NewDeviceStats(err == nil)
+		if err != nil {
+			// Outages and missing configuration aren't the device's fault.
+			if err, ok := err.(PushError); !ok || !err.DeviceFailure() {
+				stats.Failures = 0
+			}
+		}
+		if attempt > 1 {
+			stats.Retries = 1
+		}
+		// Only count round trips that got a response.
+		if _, ok := err.(PushError); ok || err == nil {
+			stats.Latencies = []time.Duration{latency}
+		}
+		recordDeviceStats(ctx, logger, deviceKey, stats)
+		if err == nil {
+			if switched {
+				logger.Warn("Pushed after switching environment, the device's environment is mislabeled",
+					"event", "environment_switched", "apns_id", id, "device_token", payload.DeviceToken)
+			}
+			logger.Info("Pushed", "event", "pushed", "apns_id", id)
+			successesTotal.With(metricLabels).Inc()
+			return NewResult(id, nil)
+		}
+		if err, ok := err.(PushError); ok && !err.Retryable() {
+			// Retrying won't help, but the token may still be good.
+			logger.Warn("Dropping notification", append(errorAttrs(err),
+				"event", "dropped",
+				"data", string(payload.Data))...)
+			droppedTotal.With(metricLabels).Inc()
+			return NewResult(id, err)
+		}
+		// A retryable error occurred. Anything other than an error response means
+		// the request never made it, most likely because the connection is dead.
+		_, isResponse := err.(PushError)
+		connectionFailed := !isResponse && ctx.Err() == nil
+		event := "push_failed"
+		if connectionFailed {
+			event = "connection_failed"
+		}
+		logger.Warn("Failed to push", append(errorAttrs(err),
+			"event", event,
+			"max_retries", policy.MaxRetries)...)
+		// Exponential backoff.
+		if attempt >= policy.MaxRetries {
+			logger.Log(ctx, dropLevel, "Dropping notification: exceeded max retries", append(errorAttrs(err),
+				"event", "dropped",
+				"data", string(payload.Data))...)
+			droppedTotal.With(metricLabels).Inc()
+			return NewResult(id, err)
+		}
+		retryableFailuresTotal.With(metricLabels).Inc()
+		delay := policy.Backoff(attempt)
+		if err, ok := err.(PushError); ok && err.RetryAfter > 0 {
+			delay = err.RetryAfter
+		}
+		if client, ok := clients.Get(app); ok && connectionFailed && platform != PlatformAndroid && platform != PlatformWeb {
+			// Retry right away on fresh connections instead of waiting to reuse a
+			// dead one.
+			if err := client.Reconnect(); err != nil {
+				logger.Error("Failed to reconnect", "event", "reconnect_failed", "error", err)
+			} else {
+				delay = 0
+			}
+		}
+		if waited+delay > policy.Budget {
+			logger.Log(ctx, dropLevel, "Dropping notification: exceeded retry budget", append(errorAttrs(err),
+				"event", "dropped",
+				"budget", policy.Budget.String(),
+				"data", string(payload.Data))...)
+			droppedTotal.With(metricLabels).Inc()
+			return NewResult(id, err)
+		}
+		if !retrying {
+			if !acquireRetry() {
+				logger.Log(ctx, dropLevel, "Dropping notification: too many retries in flight", append(errorAttrs(err),
+					"event", "dropped",
+					"retry_concurrency", cap(retrySlots),
+					"data", string(payload.Data))...)
+				droppedTotal.With(metricLabels).Inc()
+				return NewResult(id, err)
+			}
+			retrying = true
+		}
+		waited += delay
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			logger.Log(context.WithoutCancel(ctx), dropLevel, "Dropping notification: canceled", append(errorAttrs(ctx.Err()),
+				"event", "dropped",
+				"data", string(payload.Data))...)
+			droppedTotal.With(metricLabels).Inc()
+			return NewResult(id, ctx.Err())
+		}
+		attempt += 1
+	}
+}
+
+// Reports whether APNS rejected the token in a way that suggests it belongs to
+// the other environment.
+func wrongEnvironment(err PushError) bool {
+	return err.Reason == "BadDeviceToken" || err.Reason == "DeviceTokenNotForTopic"
+}
+
+// Checks the payload for problems that can be caught without contacting the
+// push provider.
+func validate(logger *slog.Logger, payload Payload, platform string) error {
+	if platform == PlatformAndroid {
+		return nil
+	}
+	if platform == PlatformWeb {
+		_, _, _, err := ParseWebSubscription(payload.DeviceToken)
+		return err
+	}
+	if !ValidAPNSToken(payload.DeviceToken) {
+		return PayloadError{BadToken: true, Reason: "malformed device token"}
+	}
+	if err := checkData(payload.Data); err != nil {
+		return err
+	}
+	data, err := payload.APNSData()
+	if err != nil {
+		return err
+	}
+	limit := maxPayloadSize(payload.PushType)
+	if len(data) > limit {
+		return PayloadError{Reason: fmt.Sprintf("data is %d bytes, limit is %d", len(data), limit), TooLarge: true}
+	}
+	// Warn well before payloads start getting rejected for being too large.
+	if payloadWarnPercent > 0 && len(data)*100 > limit*payloadWarnPercent {
+		logger.Warn("Payload is close to the size limit", "event", "payload_near_limit",
+			"size", len(data), "limit", limit, "data", string(data))
+	}
+	return nil
+}
+
+// ValidAPNSToken returns true if the token is hex and one of the lengths that
+// APNS hands out (64 characters, or up to 200 for newer tokens).
+func ValidAPNSToken(token string) bool {
+	if len(token) < 64 || len(token) > 200 || len(token)%2 != 0 {
+		return false
+	}
+	_, err := hex.DecodeString(token)
+	return err == nil
+}
+
+// NormalizeAPNSToken strips anything but hex digits from the token and lowercases
+// it, which fixes up tokens in the "<abcd ef01 ...>" format that NSData used to
+// describe itself in. Tokens that still aren't valid are returned unchanged.
+func NormalizeAPNSToken(token string) string {
+	normalized := strings.Map(func(r rune) rune {
+		switch {
+		case r >= '0' && r <= '9', r >= 'a' && r <= 'f':
+			return r
+		case r >= 'A' && r <= 'F':
+			return r - 'A' + 'a'
+		}
+		return -1
+	}, token)
+	if !ValidAPNSToken(normalized) {
+		return token
+	}
+	return normalized
+}
+
+// ValidUUID returns true if the string is a UUID in its canonical 8-4-4-4-12
+// hex form.
+func ValidUUID(s string) bool {
+	if len(s) != 36 {
+		return false
+	}
+	for i, c := range s {
+		switch i {
+		case 8, 13, 18, 23:
+			if c != '-' {
+				return false
+			}
+		default:
+			if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Builds the request for the payload without sending it. FCM is asked to only
+// validate the message instead.
+func dryRun(ctx context.Context, payload Payload, platform string) Result {
+	if platform == PlatformAndroid {
+		id, _, err := PushFCM(ctx, payload)
+		return NewResult(id, err)
+	}
+	var (
+		req  *http.Request
+		data []byte
+		err  error
+	)
+	if platform == PlatformWeb {
+		// The body is encrypted, so report the data that went into it.
+		req, err = NewWebPushRequest(ctx, payload)
+		data = payload.Data
+	} else {
+		_, req, err = NewPushRequest(ctx, payload)
+		data, _ = payload.APNSData()
+	}
+	if err != nil {
+		return NewResult("", err)
+	}
+	info := &RequestInfo{
+		Body:    string(data),
+		Headers: make(map[string]string),
+		URL:     req.URL.String(),
+	}
+	for name := range req.Header {
+		// Don't leak provider tokens.
+		if strings.EqualFold(name, "authorization") {
+			continue
+		}
+		info.Headers[strings.ToLower(name)] = req.Header.Get(name)
+	}
+	return Result{Request: info, Success: true}
+}
+
+func deleteDevice(ctx context.Context, logger *slog.Logger, key *datastore.Key) {
+	if err := store.Delete(ctx, key); err != nil {
+		datastoreErrors.Error(logger, "Failed to delete token", "event", "delete_failed", "error", err)
+		return
+	}
+	deviceDeleted(key)
+}
+
+// Lets the device webhook know that the device was deleted.
+func deviceDeleted(key *datastore.Key) {
+	if deviceWebhook == nil {
+		return
+	}
+	deviceWebhook.Send(DeviceDeletedEvent{
+		AccountID:   key.Parent.ID,
+		DeviceToken: key.Name,
+		Namespace:   key.Namespace,
+		Time:        time.Now(),
+	})
+}
+
+// Deletes the device unless it was registered after APNS found its token to be
+// invalid, in which case the app has handed out the token again since.
+func deleteUnregistered(ctx context.Context, logger *slog.Logger, key *datastore.Key, invalidated time.Time) {
+	deleted := false
+	_, err := store.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		deleted = false
+		var device Device
+		if err := tx.Get(key, &device); err != nil {
+			return err
+		}
+		if device.Created.After(invalidated) {
+			logger.Info("Keeping device registered after its token was invalidated", "event", "delete_skipped",
+				"created", device.Created, "invalidated", invalidated)
+			return nil
+		}
+		deleted = true
+		return tx.Delete(key)
+	})
+	if err != nil && err != datastore.ErrNoSuchEntity {
+		datastoreErrors.Error(logger, "Failed to delete token", "event", "delete_failed", "error", err)
+	} else if err == nil && deleted {
+		deviceDeleted(key)
+	}
+}
+
+// Moves the device stored under from to the key to, which is returned. If the
+// move fails, from is returned so that stats keep going to the existing device.
+func moveDevice(ctx context.Context, logger *slog.Logger, from, to *datastore.Key) *datastore.Key {
+	ctx, cancel := context.WithTimeout(ctx, DatastoreTimeout)
+	defer cancel()
+	_, err := store.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var device Device
+		if err := tx.Get(from, &device); err != nil {
+			return err
+		}
+		// Keep the device that's already registered under the normalized token.
+		var existing Device
+		if err := tx.Get(to, &existing); err == datastore.ErrNoSuchEntity {
+			device.Token = to.Name
+			if _, err := tx.Put(to, &device); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		}
+		return tx.Delete(from)
+	})
+	if err == datastore.ErrNoSuchEntity {
+		return to
+	} else if err != nil {
+		datastoreErrors.Error(logger, "Failed to move device to normalized token", "event", "move_failed", "error", err)
+		return from
+	}
+	return to
+}
+
+// Writes the stats change immediately, or buffers it if batching is enabled.
+func recordDeviceStats(ctx context.Context, logger *slog.Logger, key *datastore.Key, stats DeviceStats) {
+	if statsBuffer != nil {
+		statsBuffer.Add(key, stats)
+		return
+	}
+	err := updateDeviceStats(ctx, key, stats)
+	if errors.Is(err, datastore.ErrNoSuchEntity) {
+		// The device was deleted while the push was in flight.
+		logger.Info("Device no longer exists", "event", "device_missing")
+	} else if err != nil {
+		datastoreErrors.Error(logger, "Failed to update token", "event", "update_failed", "error", err)
+	}
+}
+
+func maxPayloadSize(pushType string) int {
+	if pushType == "voip" {
+		return MaxPayloadSizeVoIP
+	}
+	return MaxPayloadSize
+}
+
+// Returns log attributes describing err, including the status code and apns-id
+// of errors returned by APNS.
+func errorAttrs(err error) []any {
+	attrs := []any{"error", err.Error()}
+	if err, ok := err.(PushError); ok {
+		attrs = append(attrs, "status_code", err.StatusCode, "reason", err.Reason, "apns_id", err.ApnsID)
+	}
+	return attrs
+}
+
+func updateDeviceStats(ctx context.Context, key *datastore.Key, stats DeviceStats) error {
+	_, err := store.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		var device Device
+		if err := tx.Get(key, &device); err != nil {
+			return err
+		}
+		stats.Apply(&device)
+		_, err := tx.Put(key, &device)
+		return err
+	})
+	return err
+}
+
+// Rejects requests that don't carry the shared secret as a bearer token.
+func requireAuth(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if secret != "" && subtle.ConstantTimeCompare([]byte(token), []byte(secret)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+// Like requireAuth, but rejects every request when there is no secret, for
+// endpoints that delete devices or otherwise go beyond pushing.
+func requireSecret(handler http.HandlerFunc) http.HandlerFunc {
+	authed := requireAuth(handler)
+	return func(w http.ResponseWriter, r *http.Request) {
+		if secret == "" {
+			http.Error(w, "PUSH_SECRET is not set", http.StatusServiceUnavailable)
+			return
+		}
+		authed(w, r)
+	}
+}
+
+// Responds with the status of every app.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	statuses := make(map[string]AppStatus)
+	disabled := disabledApps.All()
+	for app, client := range clients.All() {
+		status := client.Status()
+		if since, ok := disabled[app]; ok {
+			status.Disabled = &since
+		}
+		statuses[app] = status
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statuses)
+}
+
+// TestPushResult is the outcome of a single push attempt made by an operator.
+type TestPushResult struct {
+	Result
+	LatencyMs int64  `json:"latency_ms"`
+	Reason    string `json:"reason,omitempty"`
+}
+
+// Sends a single payload right away, without retries or touching the device's
+// stats, and responds with exactly what happened.
+func testPushHandler(w http.ResponseWriter, r *http.Request) {
+	var payload Payload
+	if err := json.NewDecoder(r.Body).Decode(&payload); err != nil {
+		http.Error(w, fmt.Sprintf("invalid JSON: %s", err), http.StatusBadRequest)
+		return
+	}
+	send := Push
+	switch payload.Platform {
+	case PlatformAndroid:
+		send = PushFCM
+	case PlatformWeb:
+		send = PushWeb
+	}
+	start := time.Now()
+	id, _, err := send(r.Context(), payload)
+	result := TestPushResult{
+		Result:    NewResult(id, err),
+		LatencyMs: int64(time.Since(start) / time.Millisecond),
+	}
+	if err, ok := err.(PushError); ok {
+		result.Reason = err.Reason
+	}
+	attrs := []any{"event", "test_push", "app", payload.App, "success", result.Success}
+	if err != nil {
+		attrs = append(attrs, errorAttrs(err)...)
+	}
+	slog.Info("Sent test push", attrs...)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// DeviceStatus is the delivery stats of a device, as reported to support staff.
+type DeviceStatus struct {
+	App            string     `json:"app"`
+	AvgLatencyMs   float64    `json:"avg_latency_ms"`
+	Created        time.Time  `json:"created"`
+	Disabled       *time.Time `json:"disabled,omitempty"`
+	Environment    string     `json:"environment"`
+	Failures       int        `json:"failures"`
+	LastLatencyMs  int64      `json:"last_latency_ms"`
+	LastSuccess    *time.Time `json:"last_success,omitempty"`
+	Platform       string     `json:"platform"`
+	TotalFailures  int        `json:"total_failures"`
+	TotalRetries   int        `json:"total_retries"`
+	TotalSuccesses int        `json:"total_successes"`
+	Updated        time.Time  `json:"updated"`
+}
+
+// Responds with the stats of the device with the account_id and device_token in
+// the query string.
+func deviceStatusHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	accountID, err := strconv.ParseInt(query.Get("account_id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid account_id", http.StatusBadRequest)
+		return
+	}
+	token := query.Get("device_token")
+	if token == "" {
+		http.Error(w, "missing device_token", http.StatusBadRequest)
+		return
+	}
+	accountKey := datastore.IDKey("Account", accountID, nil)
+	accountKey.Namespace = query.Get("namespace")
+	deviceKey := DeviceKey(token, accountKey)
+	var device Device
+	if err := store.Get(r.Context(), deviceKey, &device); err == datastore.ErrNoSuchEntity {
+		http.Error(w, "no such device", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.Error("Failed to look up device", "event", "device_lookup_failed", "account_id", accountID, "error", err)
+		http.Error(w, "failed to look up device", http.StatusInternalServerError)
+		return
+	}
+	status := DeviceStatus{
+		App:            device.App,
+		AvgLatencyMs:   device.AvgLatencyMs,
+		Created:        device.Created,
+		Environment:    device.Environment,
+		Failures:       device.Failures,
+		LastLatencyMs:  device.LastLatencyMs,
+		Platform:       device.Platform,
+		TotalFailures:  device.TotalFailures,
+		TotalRetries:   device.TotalRetries,
+		TotalSuccesses: device.TotalSuccesses,
+		Updated:        device.Updated,
+	}
+	if !device.Disabled.IsZero() {
+		status.Disabled = &device.Disabled
+	}
+	if !device.LastSuccess.IsZero() {
+		status.LastSuccess = &device.LastSuccess
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+// Deletes the device with the given account ID and token, e.g. on logout.
+func deleteDeviceHandler(w http.ResponseWriter, r *http.Request) {
+	var params struct {
+		AccountID   int64  `json:"account_id"`
+		DeviceToken string `json:"device_token"`
+		Namespace   string `json:"namespace"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&params); err != nil {
+		http.Error(w, fmt.Sprintf("invalid JSON: %s", err), http.StatusBadRequest)
+		return
+	}
+	if params.DeviceToken == "" {
+		http.Error(w, "missing device_token", http.StatusBadRequest)
+		return
+	}
+	accountKey := datastore.IDKey("Account", params.AccountID, nil)
+	accountKey.Namespace = params.Namespace
+	deviceKey := DeviceKey(params.DeviceToken, accountKey)
+	_, err := store.RunInTransaction(r.Context(), func(tx *datastore.Transaction) error {
+		var device Device
+		if err := tx.Get(deviceKey, &device); err != nil {
+			return err
+		}
+		return tx.Delete(deviceKey)
+	})
+	if err == datastore.ErrNoSuchEntity {
+		http.Error(w, "no such device", http.StatusNotFound)
+		return
+	} else if err != nil {
+		slog.Error("Failed to delete token", "event", "delete_failed", "account_id", params.AccountID, "error", err)
+		http.Error(w, "failed to delete device", http.StatusInternalServerError)
+		return
+	}
+	slog.Info("Deleted token", "event", "deleted", "account_id", params.AccountID)
+	w.WriteHeader(http.StatusOK)
+	fmt.Fprintln(w, "ok")
+}
+
+func pingHandler(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(200)
+	fmt.Fprintln(w, "ok")
+}
+
+// Reports whether the first thing in the body other than whitespace is a "[".
+func startsWithArray(r *bufio.Reader) bool {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return false
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			r.ReadByte()
+		default:
+			return b[0] == '['
+		}
+	}
+}
+
+// Pushes one line at a time, writing each result as a JSON line as soon as
+// the push finishes and before reading the next line.
+func streamPushes(w http.ResponseWriter, r *http.Request, body io.Reader, validateOnly bool) {
+	rc := http.NewResponseController(w)
+	// HTTP/1.x stops reading the request once the response starts unless told
+	// otherwise. HTTP/2 always allows it, and reports this as not supported.
+	rc.EnableFullDuplex()
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	encoder := json.NewEncoder(w)
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(nil, maxLineSize)
+	for scanner.Scan() {
+		var payload Payload
+		var result Result
+		if err := json.Unmarshal(scanner.Bytes(), &payload); err != nil {
+			slog.Warn("Failed to parse JSON", "event", "invalid_json", "error", err, "line", scanner.Text())
+			result = Result{Code: CodeInvalidJSON, Error: fmt.Sprintf("invalid JSON: %s", err), Permanent: true}
+		} else {
+			if validateOnly {
+				payload.DryRun = true
+			}
+			done := make(chan Result, 1)
+			enqueue(r.Context(), payload, func(res Result) { done <- res })
+			result = <-done
+		}
+		if err := encoder.Encode(result); err != nil {
+			slog.Warn("Failed to write result", "event", "write_failed", "error", err)
+			return
+		}
+		rc.Flush()
+	}
+	if err := scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
+		slog.Error("Line is too long", "event", "line_too_long", "max_size", maxLineSize)
+		encoder.Encode(Result{Code: CodePayloadTooLarge, Error: fmt.Sprintf("line exceeds %d bytes", maxLineSize), Permanent: true})
+	} else if err != nil {
+		slog.Error("Failed to read data", "event", "read_failed", "error", err)
+	}
+}
+
+// Pushes every newline-delimited payload in the body in the background, or
+// every element of a JSON array if the body starts with "[". The body may be
+// gzipped. With ?sync=true, waits for all pushes and responds with one result
+// per payload, and with ?stream=true pushes the lines one at a time, responding
+// with each result as it comes. Payloads beyond MAX_LINES are ignored. Responds
+// with 400 if any payload was invalid in sync mode, or if every payload was
+// invalid otherwise.
+func pushHandler(w http.ResponseWriter, r *http.Request) {
+	wait, _ := strconv.ParseBool(r.URL.Query().Get("sync"))
+	validateOnly, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	var body io.Reader = r.Body
+	switch encoding := r.Header.Get("Content-Encoding"); encoding {
+	case "", "identity":
+	case "gzip":
+		gz, err := gzip.NewReader(r.Body)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid gzip data: %s", err), http.StatusBadRequest)
+			return
+		}
+		defer gz.Close()
+		// Also limit what it decompresses to.
+		body = http.MaxBytesReader(w, gz, maxBodySize)
+	default:
+		http.Error(w, fmt.Sprintf("unsupported Content-Encoding \"%s\"", encoding), http.StatusUnsupportedMediaType)
+		return
+	}
+	if stream, _ := strconv.ParseBool(r.URL.Query().Get("stream")); stream {
+		streamPushes(w, r, body, validateOnly)
+		return
+	}
+	var (
+		invalid []string
+		parsed  int
+		results []*Result
+		wg      sync.WaitGroup
+	)
+	// Pushes one payload, where n is its line number (or index in an array).
+	handle := func(n int, data []byte) {
+		var payload Payload
+		if err := json.Unmarshal(data, &payload); err != nil {
+			slog.Warn("Failed to parse JSON", "event", "invalid_json", "error", err, "line", string(data))
+			invalid = append(invalid, fmt.Sprintf("line %d: %s", n, err))
+			results = append(results, &Result{Code: CodeInvalidJSON, Error: fmt.Sprintf("invalid JSON: %s", err), Permanent: true})
+			return
+		}
+		parsed++
+		if validateOnly {
+			payload.DryRun = true
+		}
+		if !wait {
+			enqueue(pushCtx, payload, nil)
+			return
+		}
+		result := new(Result)
+		results = append(results, result)
+		wg.Add(1)
+		enqueue(r.Context(), payload, func(res Result) {
+			*result = res
+			wg.Done()
+		})
+	}
+	buffered := bufio.NewReader(body)
+	var (
+		err       error
+		truncated bool
+	)
+	if startsWithArray(buffered) {
+		// A JSON array of payloads rather than newline-delimited JSON.
+		var items []json.RawMessage
+		if err = json.NewDecoder(buffered).Decode(&items); err == nil {
+			if len(items) > maxLines {
+				items, truncated = items[:maxLines], true
+			}
+			for i, item := range items {
+				handle(i+1, item)
+			}
+		} else if !errors.As(err, new(*http.MaxBytesError)) {
+			http.Error(w, fmt.Sprintf("invalid JSON: %s", err), http.StatusBadRequest)
+			return
+		}
+	} else {
+		scanner := bufio.NewScanner(buffered)
+		scanner.Buffer(nil, maxLineSize)
+		line := 0
+		for scanner.Scan() {
+			if line >= maxLines {
+				truncated = true
+				break
+			}
+			line++
+			handle(line, scanner.Bytes())
+		}
+		if err = scanner.Err(); errors.Is(err, bufio.ErrTooLong) {
+			// Scanning can't continue past a line that doesn't fit in the buffer.
+			slog.Error("Line is too long", "event", "line_too_long", "line", line+1, "max_size", maxLineSize)
+			reason := fmt.Sprintf("line exceeds %d bytes", maxLineSize)
+			invalid = append(invalid, fmt.Sprintf("line %d: %s", line+1, reason))
+			results = append(results, &Result{Code: CodePayloadTooLarge, Error: reason, Permanent: true})
+			err = nil
+		}
+	}
+	if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+		slog.Error("Body is too large", "event", "body_too_large", "max_size", maxBodySize)
+		http.Error(w, fmt.Sprintf("body exceeds %d bytes", maxBodySize), http.StatusRequestEntityTooLarge)
+		return
+	} else if err != nil {
+		slog.Error("Failed to read data", "event", "read_failed", "error", err)
+	}
+	if truncated {
+		slog.Warn("Ignoring payloads beyond the limit", "event", "too_many_lines", "max_lines", maxLines)
+		w.Header().Set("Push-Truncated", strconv.Itoa(maxLines))
+		results = append(results, &Result{
+			Code:      CodeTooManyPayloads,
+			Error:     fmt.Sprintf("only the first %d payloads were pushed", maxLines),
+			Permanent: true,
+		})
+	}
+	if !wait {
+		if parsed == 0 && len(invalid) > 0 {
+			http.Error(w, "invalid payloads:\n"+strings.Join(invalid, "\n"), http.StatusBadRequest)
+		}
+		return
+	}
+	wg.Wait()
+	w.Header().Set("Content-Type", "application/json")
+	if len(invalid) > 0 {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	json.NewEncoder(w).Encode(results)
+}
+
+// Pushes one payload to every target in the batch and responds with a summary
+// once all of them have finished.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	var batch Batch
+	if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+		if tooLarge := new(http.MaxBytesError); errors.As(err, &tooLarge) {
+			slog.Error("Body is too large", "event", "body_too_large", "max_size", maxBodySize)
+			http.Error(w, fmt.Sprintf("body exceeds %d bytes", maxBodySize), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(w, fmt.Sprintf("invalid JSON: %s", err), http.StatusBadRequest)
+		return
+	}
+	var (
+		mu      sync.Mutex
+		summary = BatchSummary{FailedTokens: []string{}}
+		wg      sync.WaitGroup
+		// Batches often target many devices of the same account.
+		accountKeys = make(map[int64]*datastore.Key)
+	)
+	for _, target := range batch.Targets {
+		payload := batch.Payload
+		payload.AccountID = target.AccountID
+		if accountKeys[target.AccountID] == nil {
+			accountKeys[target.AccountID] = payload.AccountKey()
+		}
+		payload.accountKey = accountKeys[target.AccountID]
+		payload.DeviceToken = target.DeviceToken
+		if target.Environment != "" {
+			payload.Environment = target.Environment
+		}
+		wg.Add(1)
+		enqueue(r.Context(), payload, func(res Result) {
+			defer wg.Done()
+			mu.Lock()
+			defer mu.Unlock()
+			switch {
+			case res.Success:
+				summary.Succeeded++
+			case res.Permanent:
+				summary.Failed++
+				summary.FailedTokens = append(summary.FailedTokens, payload.DeviceToken)
+			default:
+				summary.Dropped++
+			}
+		})
 	}
+	wg.Wait()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
 }
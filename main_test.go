@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+const testToken = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+
+// Registers a client for the app that is never connected, which is enough to
+// build requests for it.
+func addTestClient(t *testing.T, config AppConfig) *Client {
+	t.Helper()
+	client := &Client{Config: config}
+	clients.mu.Lock()
+	clients.clients[config.App] = client
+	clients.mu.Unlock()
+	t.Cleanup(func() {
+		clients.Remove(config.App)
+	})
+	return client
+}
+
+func TestNewPushRequestCollapseIDAndID(t *testing.T) {
+	addTestClient(t, AppConfig{App: "com.example.app"})
+	payload := Payload{
+		App:         "com.example.app",
+		Body:        "Hello",
+		CollapseID:  "thread-1",
+		DeviceToken: testToken,
+		ID:          "123e4567-e89b-12d3-a456-426614174000",
+	}
+	_, req, err := NewPushRequest(context.Background(), payload)
+	if err != nil {
+		t.Fatalf("NewPushRequest: %v", err)
+	}
+	if got := req.Header.Get("apns-collapse-id"); got != payload.CollapseID {
+		t.Errorf("apns-collapse-id = %q, want %q", got, payload.CollapseID)
+	}
+	if got := req.Header.Get("apns-id"); got != payload.ID {
+		t.Errorf("apns-id = %q, want %q", got, payload.ID)
+	}
+}
+
+func TestNewPushRequestBackgroundPriority(t *testing.T) {
+	addTestClient(t, AppConfig{App: "com.example.app"})
+	payload := Payload{
+		App:         "com.example.app",
+		Data:        []byte(`{"aps":{"content-available":1}}`),
+		DeviceToken: testToken,
+		PushType:    "background",
+	}
+	_, req, err := NewPushRequest(context.Background(), payload)
+	if err != nil {
+		t.Fatalf("NewPushRequest: %v", err)
+	}
+	if got := req.Header.Get("apns-priority"); got != "5" {
+		t.Errorf("apns-priority = %q, want 5", got)
+	}
+}
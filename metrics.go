@@ -0,0 +1,100 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	pushesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "push_notifications_total",
+		Help: "Notifications received for delivery.",
+	}, []string{"app", "environment"})
+	successesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "push_successes_total",
+		Help: "Notifications accepted by the push provider.",
+	}, []string{"app", "environment"})
+	permanentFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "push_permanent_failures_total",
+		Help: "Notifications rejected with a permanent error.",
+	}, []string{"app", "environment"})
+	retryableFailuresTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "push_retryable_failures_total",
+		Help: "Failed push attempts that were retried.",
+	}, []string{"app", "environment"})
+	droppedTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "push_dropped_total",
+		Help: "Notifications given up on without being delivered.",
+	}, []string{"app", "environment"})
+	apnsLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "push_apns_request_duration_seconds",
+		Help:    "Latency of requests to APNS.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"app", "environment"})
+	buildLatency = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "push_apns_request_build_duration_seconds",
+		Help:    "Time spent building requests to APNS, including encoding and signing.",
+		Buckets: prometheus.ExponentialBuckets(0.00001, 4, 10),
+	}, []string{"app", "environment"})
+	streamWait = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "push_apns_stream_wait_seconds",
+		Help:    "Time spent waiting for one of the app's max_streams to free up.",
+		Buckets: prometheus.ExponentialBuckets(0.0001, 4, 10),
+	}, []string{"app", "environment"})
+	streamsInUse = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "push_apns_streams_in_use",
+		Help: "Requests to APNS currently in flight.",
+	}, []string{"app"})
+	connectionsOpened = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "push_apns_connections_opened_total",
+		Help: "Connections opened to APNS.",
+	}, []string{"app"})
+	connectionsClosed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "push_apns_connections_closed_total",
+		Help: "Connections to APNS that were closed, by either side.",
+	}, []string{"app"})
+	connectionsActive = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "push_apns_connections",
+		Help: "Connections to APNS that are currently open.",
+	}, []string{"app"})
+	pushesInFlight = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "push_in_flight",
+		Help: "Notifications currently being pushed by a worker, including retries.",
+	})
+	queueDepth = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "push_queue_depth",
+		Help: "Notifications waiting for a worker.",
+	}, func() float64 { return float64(len(queue)) })
+	retriesInFlight = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Name: "push_retries_in_flight",
+		Help: "Notifications currently holding one of the RETRY_CONCURRENCY slots.",
+	}, func() float64 { return float64(len(retrySlots)) })
+)
+
+func init() {
+	prometheus.MustRegister(
+		pushesTotal,
+		successesTotal,
+		permanentFailuresTotal,
+		retryableFailuresTotal,
+		droppedTotal,
+		apnsLatency,
+		buildLatency,
+		streamWait,
+		streamsInUse,
+		connectionsOpened,
+		connectionsClosed,
+		connectionsActive,
+		pushesInFlight,
+		queueDepth,
+		retriesInFlight,
+	)
+}
+
+// Returns the metric labels for a payload.
+func labels(payload Payload) prometheus.Labels {
+	env := payload.Environment
+	if env == "" {
+		env = "production"
+	}
+	return prometheus.Labels{"app": payload.App, "environment": env}
+}
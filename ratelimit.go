@@ -0,0 +1,61 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimiter is a token bucket per device token, allowing up to PerMinute
+// pushes a minute to each device, in bursts of at most PerMinute.
+type RateLimiter struct {
+	PerMinute int
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	pruned  time.Time
+}
+
+type bucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func NewRateLimiter(perMinute int) *RateLimiter {
+	return &RateLimiter{PerMinute: perMinute, buckets: make(map[string]*bucket)}
+}
+
+// Allow reports whether another push to the device token is allowed right now.
+func (l *RateLimiter) Allow(token string) bool {
+	now := time.Now()
+	max := float64(l.PerMinute)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	// Buckets that have filled up again are the same as no bucket at all.
+	if now.Sub(l.pruned) > time.Minute {
+		for key, b := range l.buckets {
+			if b.fill(now, max) >= max {
+				delete(l.buckets, key)
+			}
+		}
+		l.pruned = now
+	}
+	b, ok := l.buckets[token]
+	if !ok {
+		b = &bucket{tokens: max, updated: now}
+		l.buckets[token] = b
+	}
+	if b.fill(now, max) < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (b *bucket) fill(now time.Time, max float64) float64 {
+	b.tokens += now.Sub(b.updated).Minutes() * max
+	if b.tokens > max {
+		b.tokens = max
+	}
+	b.updated = now
+	return b.tokens
+}
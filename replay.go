@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+const (
+	// How many dead letters a single replay request handles at most.
+	DefaultReplayLimit = 1000
+	// How many dead letters are pushed per second while replaying.
+	DefaultReplayRate = 50
+	// The most dead letters a replay may push per second.
+	MaxReplayRate = 1000
+)
+
+type ReplaySummary struct {
+	Failed   int `json:"failed"`
+	Invalid  int `json:"invalid"`
+	Replayed int `json:"replayed"`
+}
+
+// Pushes the stored FailedPush entities again, optionally only those for the
+// app in ?app= and created between ?since= and ?until= (RFC 3339). Entities are
+// deleted once their push succeeds, and kept as they are otherwise. Up to
+// ?limit= entities are replayed, ?rate= per second (at most MaxReplayRate).
+func replayHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	q := datastore.NewQuery("FailedPush")
+	if app := query.Get("app"); app != "" {
+		q = q.FilterField("app", "=", app)
+	}
+	for param, op := range map[string]string{"since": ">=", "until": "<"} {
+		if s := query.Get(param); s != "" {
+			t, err := time.Parse(time.RFC3339, s)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid %s", param), http.StatusBadRequest)
+				return
+			}
+			q = q.FilterField("created", op, t)
+		}
+	}
+	limit, rate := DefaultReplayLimit, DefaultReplayRate
+	for param, value := range map[string]*int{"limit": &limit, "rate": &rate} {
+		if s := query.Get(param); s != "" {
+			n, err := strconv.Atoi(s)
+			if err != nil || n <= 0 {
+				http.Error(w, fmt.Sprintf("invalid %s", param), http.StatusBadRequest)
+				return
+			}
+			*value = n
+		}
+	}
+	if rate > MaxReplayRate {
+		http.Error(w, fmt.Sprintf("rate can't be more than %d", MaxReplayRate), http.StatusBadRequest)
+		return
+	}
+	var failed []FailedPush
+	keys, err := store.GetAll(r.Context(), q.Limit(limit), &failed)
+	if err != nil {
+		slog.Error("Failed to look up dead letters", "event", "replay_failed", "error", err)
+		http.Error(w, "failed to look up dead letters", http.StatusInternalServerError)
+		return
+	}
+	var (
+		mu      sync.Mutex
+		summary ReplaySummary
+		wg      sync.WaitGroup
+	)
+	ticker := time.NewTicker(time.Second / time.Duration(rate))
+	defer ticker.Stop()
+	for i, entity := range failed {
+		var payload Payload
+		if err := json.Unmarshal(entity.Payload, &payload); err != nil {
+			summary.Invalid++
+			continue
+		}
+		// A failed replay keeps the existing dead letter instead of adding another.
+		payload.replay = true
+		select {
+		case <-ticker.C:
+		case <-r.Context().Done():
+			http.Error(w, "canceled", http.StatusServiceUnavailable)
+			return
+		}
+		key := keys[i]
+		wg.Add(1)
+		enqueue(r.Context(), payload, func(result Result) {
+			defer wg.Done()
+			if !result.Success {
+				mu.Lock()
+				summary.Failed++
+				mu.Unlock()
+				return
+			}
+			if err := store.Delete(r.Context(), key); err != nil {
+				datastoreErrors.Error(slog.Default(), "Failed to delete dead letter", "event", "delete_failed", "error", err)
+			}
+			mu.Lock()
+			summary.Replayed++
+			mu.Unlock()
+		})
+	}
+	wg.Wait()
+	slog.Info("Replayed dead letters", "event", "replayed",
+		"replayed", summary.Replayed, "failed", summary.Failed, "invalid", summary.Invalid)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	DefaultBackoffBase      = time.Second
+	DefaultBackoffMax       = 30 * time.Second
+	DefaultMaxRetries       = 3
+	DefaultRetryBudget      = time.Minute
+	DefaultRetryConcurrency = 25
+
+	DefaultImportantMaxRetries  = 10
+	DefaultImportantRetryBudget = 10 * time.Minute
+)
+
+// RetryPolicy controls how many times push attempts delivery and how long it
+// waits between attempts.
+type RetryPolicy struct {
+	// MaxRetries is the total number of attempts, including the first one.
+	MaxRetries int
+	// The wait doubles after every attempt, starting at BackoffBase, but never
+	// exceeds BackoffMax.
+	BackoffBase time.Duration
+	BackoffMax  time.Duration
+	// Budget is the most time push spends waiting between attempts in total,
+	// including waits requested by Retry-After.
+	Budget time.Duration
+}
+
+var retryPolicy = RetryPolicy{
+	MaxRetries:  DefaultMaxRetries,
+	BackoffBase: DefaultBackoffBase,
+	BackoffMax:  DefaultBackoffMax,
+	Budget:      DefaultRetryBudget,
+}
+
+// The retry policy for payloads marked as important.
+var importantRetryPolicy = RetryPolicy{
+	MaxRetries:  DefaultImportantMaxRetries,
+	BackoffBase: DefaultBackoffBase,
+	BackoffMax:  DefaultBackoffMax,
+	Budget:      DefaultImportantRetryBudget,
+}
+
+// Limits how many pushes can be retrying at once across every request, so that
+// when APNS starts throttling, a large batch doesn't multiply the load by
+// retrying every payload in it. Nil means there is no limit.
+var retrySlots chan struct{}
+
+// Takes a retry slot if one is free. Pushes hold on to their slot until they
+// are done, however many more attempts that takes.
+func acquireRetry() bool {
+	if retrySlots == nil {
+		return true
+	}
+	select {
+	case retrySlots <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func releaseRetry() {
+	if retrySlots != nil {
+		<-retrySlots
+	}
+}
+
+// Reads a retry policy from the environment variables starting with prefix,
+// keeping the defaults for anything that isn't set.
+func LoadRetryPolicy(prefix string, defaults RetryPolicy) RetryPolicy {
+	return RetryPolicy{
+		MaxRetries:  getenvInt(prefix+"MAX_RETRIES", defaults.MaxRetries),
+		BackoffBase: getenvDuration(prefix+"BACKOFF_BASE", defaults.BackoffBase),
+		BackoffMax:  getenvDuration(prefix+"BACKOFF_MAX", defaults.BackoffMax),
+		Budget:      getenvDuration(prefix+"RETRY_BUDGET", defaults.Budget),
+	}
+}
+
+// Backoff returns how long to wait after the given (1-based) attempt failed.
+// Half of the wait is randomized ("equal jitter") so that pushes which failed
+// at the same time don't all retry at the same time.
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	delay := p.BackoffBase
+	for i := 1; i < attempt && delay < p.BackoffMax; i++ {
+		delay *= 2
+	}
+	if delay > p.BackoffMax {
+		delay = p.BackoffMax
+	}
+	half := delay / 2
+	if half <= 0 {
+		return delay
+	}
+	return half + time.Duration(rand.Int63n(int64(half)+1))
+}
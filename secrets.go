@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	SecretManagerHost  = "https://secretmanager.googleapis.com"
+	SecretManagerScope = "https://www.googleapis.com/auth/cloud-platform"
+)
+
+// SecretSource loads certificates and signing keys by file name, e.g.
+// "cam.reaction.ReactionCam.pem".
+type SecretSource interface {
+	Read(name string) ([]byte, error)
+}
+
+// NewSecretSource picks a source by name: "file" (the default), "env" or
+// "secretmanager".
+func NewSecretSource(ctx context.Context, kind string) (SecretSource, error) {
+	switch kind {
+	case "", "file":
+		return FileSource("secrets"), nil
+	case "env":
+		return EnvSource{}, nil
+	case "secretmanager":
+		client, err := google.DefaultClient(ctx, SecretManagerScope)
+		if err != nil {
+			return nil, err
+		}
+		client.Timeout = 10 * time.Second
+		return &SecretManagerSource{Client: client, Project: projectId}, nil
+	default:
+		return nil, fmt.Errorf("unknown secret source \"%s\"", kind)
+	}
+}
+
+// FileSource reads secrets from files in a directory.
+type FileSource string
+
+func (dir FileSource) Read(name string) ([]byte, error) {
+	return ioutil.ReadFile(filepath.Join(string(dir), name))
+}
+
+// EnvSource reads base64 encoded secrets from environment variables, where
+// "cam.reaction.ReactionCam.pem" is read from SECRET_CAM_REACTION_REACTIONCAM_PEM.
+type EnvSource struct{}
+
+func (EnvSource) Read(name string) ([]byte, error) {
+	variable := "SECRET_" + strings.ToUpper(strings.Replace(secretID(name), "-", "_", -1))
+	value := os.Getenv(variable)
+	if value == "" {
+		return nil, fmt.Errorf("%s is not set", variable)
+	}
+	return base64.StdEncoding.DecodeString(value)
+}
+
+// SecretManagerSource reads the latest version of secrets from Google Secret
+// Manager, where "cam.reaction.ReactionCam.pem" is read from the secret
+// cam_reaction_ReactionCam_pem.
+type SecretManagerSource struct {
+	Client  *http.Client
+	Project string
+}
+
+func (s *SecretManagerSource) Read(name string) ([]byte, error) {
+	url := fmt.Sprintf("%s/v1/projects/%s/secrets/%s/versions/latest:access", SecretManagerHost, s.Project, secretID(name))
+	resp, err := s.Client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to access secret %s: %d %s", secretID(name), resp.StatusCode, body)
+	}
+	var result struct {
+		Payload struct {
+			Data []byte `json:"data"`
+		} `json:"payload"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return nil, err
+	}
+	return result.Payload.Data, nil
+}
+
+// Secret IDs and environment variable names can't contain dots.
+func secretID(name string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' {
+			return r
+		}
+		return '_'
+	}, name)
+}
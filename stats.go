@@ -0,0 +1,209 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Datastore doesn't allow more than this many entities per batch operation.
+const MaxBatchSize = 500
+
+// How much the latest push latency weighs into a device's moving average.
+const LatencyWeight = 0.2
+
+// DeviceStats is a change to the delivery stats of a device. Several changes
+// to the same device can be merged into one before being written.
+type DeviceStats struct {
+	// Failures since the last success, or all failures if Reset is false.
+	Failures      int
+	Latencies     []time.Duration
+	LastSuccess   time.Time
+	Reset         bool
+	Retries       int
+	Successes     int
+	TotalFailures int
+	Updated       time.Time
+}
+
+func NewDeviceStats(success bool) DeviceStats {
+	now := time.Now()
+	if success {
+		return DeviceStats{LastSuccess: now, Reset: true, Successes: 1, Updated: now}
+	}
+	return DeviceStats{Failures: 1, TotalFailures: 1, Updated: now}
+}
+
+// Merge adds a later change on top of this one.
+func (s *DeviceStats) Merge(later DeviceStats) {
+	if later.Reset {
+		s.Failures = later.Failures
+		s.LastSuccess = later.LastSuccess
+		s.Reset = true
+	} else {
+		s.Failures += later.Failures
+	}
+	s.Latencies = append(s.Latencies, later.Latencies...)
+	s.Retries += later.Retries
+	s.Successes += later.Successes
+	s.TotalFailures += later.TotalFailures
+	s.Updated = later.Updated
+}
+
+// Apply updates the device entity with the change, disabling it if it has
+// failed too many times in a row.
+func (s DeviceStats) Apply(device *Device) {
+	if s.Reset {
+		device.Failures = s.Failures
+		device.LastSuccess = s.LastSuccess
+	} else {
+		device.Failures += s.Failures
+	}
+	if disableAfter > 0 && device.Failures >= disableAfter && device.Disabled.IsZero() {
+		device.Disabled = s.Updated
+	}
+	for _, latency := range s.Latencies {
+		ms := float64(latency) / float64(time.Millisecond)
+		if device.LastLatencyMs == 0 && device.AvgLatencyMs == 0 {
+			device.AvgLatencyMs = ms
+		} else {
+			device.AvgLatencyMs += LatencyWeight * (ms - device.AvgLatencyMs)
+		}
+		device.LastLatencyMs = int64(latency / time.Millisecond)
+	}
+	device.TotalRetries += s.Retries
+	device.TotalSuccesses += s.Successes
+	device.TotalFailures += s.TotalFailures
+	device.Updated = s.Updated
+}
+
+// StatsBuffer coalesces device stats in memory so they can be written in
+// batches instead of one transaction per push.
+type StatsBuffer struct {
+	MaxSize int
+
+	mu      sync.Mutex
+	pending map[string]*bufferedStats
+	flush   chan struct{}
+}
+
+type bufferedStats struct {
+	key   *datastore.Key
+	stats DeviceStats
+}
+
+func NewStatsBuffer(maxSize int) *StatsBuffer {
+	return &StatsBuffer{
+		MaxSize: maxSize,
+		pending: make(map[string]*bufferedStats),
+		flush:   make(chan struct{}, 1),
+	}
+}
+
+// Add buffers a change, triggering a flush once MaxSize devices are pending.
+func (b *StatsBuffer) Add(key *datastore.Key, stats DeviceStats) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if entry, ok := b.pending[key.Encode()]; ok {
+		entry.stats.Merge(stats)
+	} else {
+		b.pending[key.Encode()] = &bufferedStats{key, stats}
+	}
+	if len(b.pending) >= b.MaxSize {
+		select {
+		case b.flush <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Run flushes the buffer every interval, or sooner if it fills up.
+func (b *StatsBuffer) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-b.flush:
+		}
+		b.Flush()
+	}
+}
+
+// Puts back changes that failed to be written, so that the next flush retries
+// them along with anything that came in since.
+func (b *StatsBuffer) requeue(entries []*bufferedStats) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, entry := range entries {
+		key := entry.key.Encode()
+		if newer, ok := b.pending[key]; ok {
+			entry.stats.Merge(newer.stats)
+		}
+		b.pending[key] = entry
+	}
+}
+
+// Flush writes all pending changes to datastore.
+func (b *StatsBuffer) Flush() {
+	b.mu.Lock()
+	entries := make([]*bufferedStats, 0, len(b.pending))
+	for _, entry := range b.pending {
+		entries = append(entries, entry)
+	}
+	b.pending = make(map[string]*bufferedStats)
+	b.mu.Unlock()
+	for len(entries) > 0 {
+		n := len(entries)
+		if n > MaxBatchSize {
+			n = MaxBatchSize
+		}
+		if err := writeStats(entries[:n]); err != nil {
+			datastoreErrors.Error(slog.Default(), "Failed to flush device stats", "event", "stats_flush_failed", "devices", n, "error", err)
+			b.requeue(entries[:n])
+		}
+		entries = entries[n:]
+	}
+}
+
+// Applies the changes in a single transaction, so that devices deleted or
+// updated elsewhere in the meantime, e.g. by another replica's flush, aren't
+// overwritten with what they were before.
+func writeStats(entries []*bufferedStats) error {
+	keys := make([]*datastore.Key, len(entries))
+	for i, entry := range entries {
+		keys[i] = entry.key
+	}
+	_, err := store.RunInTransaction(ctx, func(tx *datastore.Transaction) error {
+		devices := make([]Device, len(entries))
+		err := tx.GetMulti(keys, devices)
+		errs, _ := err.(datastore.MultiError)
+		if err != nil && errs == nil {
+			return err
+		}
+		var (
+			putKeys    []*datastore.Key
+			putDevices []*Device
+		)
+		for i, entry := range entries {
+			if errs != nil && errs[i] != nil {
+				// Devices that were deleted in the meantime are skipped.
+				if errs[i] != datastore.ErrNoSuchEntity {
+					datastoreErrors.Error(slog.Default(), "Failed to get device stats", "event", "stats_flush_failed", "error", errs[i])
+				}
+				continue
+			}
+			entry.stats.Apply(&devices[i])
+			putKeys = append(putKeys, entry.key)
+			putDevices = append(putDevices, &devices[i])
+		}
+		if len(putKeys) == 0 {
+			return nil
+		}
+		_, err = tx.PutMulti(putKeys, putDevices)
+		return err
+	})
+	return err
+}
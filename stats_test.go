@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/datastore"
+)
+
+// Points store at the datastore emulator for the duration of the test, and
+// returns a function that makes device keys in a namespace of the test's own.
+// The test is skipped unless DATASTORE_EMULATOR_HOST is set.
+func useEmulator(t *testing.T) func(token string) *datastore.Key {
+	t.Helper()
+	if os.Getenv("DATASTORE_EMULATOR_HOST") == "" {
+		t.Skip("DATASTORE_EMULATOR_HOST is not set")
+	}
+	client, err := datastore.NewClient(context.Background(), "roger-test")
+	if err != nil {
+		t.Fatalf("datastore.NewClient: %v", err)
+	}
+	previous := store
+	store = client
+	t.Cleanup(func() {
+		store = previous
+		client.Close()
+	})
+	namespace := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	return func(token string) *datastore.Key {
+		key := datastore.NameKey("Device", token, nil)
+		key.Namespace = namespace
+		return key
+	}
+}
+
+func putDevice(t *testing.T, key *datastore.Key, device Device) {
+	t.Helper()
+	if _, err := store.Put(context.Background(), key, &device); err != nil {
+		t.Fatalf("Put: %v", err)
+	}
+}
+
+func getDevice(t *testing.T, key *datastore.Key) Device {
+	t.Helper()
+	var device Device
+	if err := store.Get(context.Background(), key, &device); err != nil {
+		t.Fatalf("Get: %v", err)
+	}
+	return device
+}
+
+func TestUpdateDeviceStats(t *testing.T) {
+	deviceKey := useEmulator(t)
+	key := deviceKey("a")
+	putDevice(t, key, Device{Token: "a"})
+	for i := 0; i < 2; i++ {
+		if err := updateDeviceStats(ctx, key, NewDeviceStats(false)); err != nil {
+			t.Fatalf("updateDeviceStats: %v", err)
+		}
+	}
+	if device := getDevice(t, key); device.Failures != 2 || device.TotalFailures != 2 {
+		t.Errorf("failures = %d, total_failures = %d, want 2 and 2", device.Failures, device.TotalFailures)
+	}
+	success := NewDeviceStats(true)
+	success.Latencies = []time.Duration{50 * time.Millisecond}
+	if err := updateDeviceStats(ctx, key, success); err != nil {
+		t.Fatalf("updateDeviceStats: %v", err)
+	}
+	device := getDevice(t, key)
+	if device.Failures != 0 || device.TotalFailures != 2 || device.TotalSuccesses != 1 {
+		t.Errorf("failures = %d, total_failures = %d, total_successes = %d, want 0, 2 and 1",
+			device.Failures, device.TotalFailures, device.TotalSuccesses)
+	}
+	if device.LastLatencyMs != 50 || device.AvgLatencyMs != 50 {
+		t.Errorf("last_latency_ms = %d, avg_latency_ms = %g, want 50 and 50", device.LastLatencyMs, device.AvgLatencyMs)
+	}
+	if device.LastSuccess.IsZero() {
+		t.Error("last_success isn't set")
+	}
+}
+
+func TestUpdateDeviceStatsMissingDevice(t *testing.T) {
+	deviceKey := useEmulator(t)
+	key := deviceKey("missing")
+	if err := updateDeviceStats(ctx, key, NewDeviceStats(true)); !errors.Is(err, datastore.ErrNoSuchEntity) {
+		t.Errorf("updateDeviceStats = %v, want %v", err, datastore.ErrNoSuchEntity)
+	}
+}
+
+func TestStatsBufferFlush(t *testing.T) {
+	deviceKey := useEmulator(t)
+	a, b, missing := deviceKey("a"), deviceKey("b"), deviceKey("missing")
+	putDevice(t, a, Device{Token: "a", Failures: 1, TotalFailures: 1})
+	putDevice(t, b, Device{Token: "b"})
+	buffer := NewStatsBuffer(DefaultStatsBatchSize)
+	buffer.Add(a, NewDeviceStats(false))
+	buffer.Add(a, NewDeviceStats(true))
+	buffer.Add(a, NewDeviceStats(false))
+	buffer.Add(b, NewDeviceStats(true))
+	buffer.Add(missing, NewDeviceStats(true))
+	buffer.Flush()
+	if device := getDevice(t, a); device.Failures != 1 || device.TotalFailures != 3 || device.TotalSuccesses != 1 {
+		t.Errorf("a: failures = %d, total_failures = %d, total_successes = %d, want 1, 3 and 1",
+			device.Failures, device.TotalFailures, device.TotalSuccesses)
+	}
+	if device := getDevice(t, b); device.Failures != 0 || device.TotalSuccesses != 1 {
+		t.Errorf("b: failures = %d, total_successes = %d, want 0 and 1", device.Failures, device.TotalSuccesses)
+	}
+	// Stats for devices that don't exist are dropped rather than creating them.
+	var device Device
+	if err := store.Get(context.Background(), missing, &device); err != datastore.ErrNoSuchEntity {
+		t.Errorf("Get missing device = %v, want %v", err, datastore.ErrNoSuchEntity)
+	}
+	if len(buffer.pending) != 0 {
+		t.Errorf("%d devices still pending after flush", len(buffer.pending))
+	}
+}
+
+func TestStatsBufferFlushDisablesDevice(t *testing.T) {
+	deviceKey := useEmulator(t)
+	previous := disableAfter
+	disableAfter = 3
+	t.Cleanup(func() {
+		disableAfter = previous
+	})
+	key := deviceKey("a")
+	putDevice(t, key, Device{Token: "a", Failures: 1})
+	buffer := NewStatsBuffer(DefaultStatsBatchSize)
+	buffer.Add(key, NewDeviceStats(false))
+	buffer.Flush()
+	if device := getDevice(t, key); !device.Disabled.IsZero() {
+		t.Errorf("disabled after %d failures", device.Failures)
+	}
+	buffer.Add(key, NewDeviceStats(false))
+	buffer.Flush()
+	if device := getDevice(t, key); device.Disabled.IsZero() {
+		t.Errorf("not disabled after %d failures", device.Failures)
+	}
+}
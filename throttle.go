@@ -0,0 +1,37 @@
+package main
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// Datastore errors tend to come all at once during an outage, so only one of
+// them is logged every DatastoreErrorInterval.
+const DatastoreErrorInterval = 10 * time.Second
+
+var datastoreErrors = &LogThrottle{Interval: DatastoreErrorInterval}
+
+// LogThrottle logs at most one error per interval, counting the ones it leaves
+// out in between.
+type LogThrottle struct {
+	Interval time.Duration
+
+	mu         sync.Mutex
+	last       time.Time
+	suppressed int
+}
+
+func (t *LogThrottle) Error(logger *slog.Logger, msg string, args ...any) {
+	t.mu.Lock()
+	if time.Since(t.last) < t.Interval {
+		t.suppressed++
+		t.mu.Unlock()
+		return
+	}
+	suppressed := t.suppressed
+	t.last = time.Now()
+	t.suppressed = 0
+	t.mu.Unlock()
+	logger.Error(msg, append(args, "suppressed", suppressed)...)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// APNS rejects provider tokens older than an hour, and also rejects tokens that
+// are regenerated more often than every 20 minutes.
+const TokenLifetime = 40 * time.Minute
+
+// TokenSigner generates and caches the ES256 JWT used for token-based APNS auth.
+type TokenSigner struct {
+	KeyID  string
+	TeamID string
+
+	key    *ecdsa.PrivateKey
+	mu     sync.Mutex
+	issued time.Time
+	token  string
+}
+
+// NewTokenSigner parses the contents of a .p8 signing key.
+func NewTokenSigner(data []byte, keyID, teamID string) (*TokenSigner, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM data found in key file")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("key is not an ECDSA private key")
+	}
+	return &TokenSigner{KeyID: keyID, TeamID: teamID, key: key}, nil
+}
+
+// Token returns a signed provider token, regenerating it when it gets too old.
+func (ts *TokenSigner) Token() (string, error) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	if ts.token != "" && time.Since(ts.issued) < TokenLifetime {
+		return ts.token, nil
+	}
+	now := time.Now()
+	token, err := ts.sign(now)
+	if err != nil {
+		return "", err
+	}
+	ts.issued = now
+	ts.token = token
+	return token, nil
+}
+
+// Reset discards the cached token so that the next one is freshly signed, if
+// it's still the rejected token. Pushes that were signed before the token was
+// last regenerated can't make it regenerate again, which APNS would reject as
+// TooManyProviderTokenUpdates.
+func (ts *TokenSigner) Reset(rejected string) {
+	ts.mu.Lock()
+	if ts.token == rejected {
+		ts.token = ""
+	}
+	ts.mu.Unlock()
+}
+
+func (ts *TokenSigner) sign(now time.Time) (string, error) {
+	header := map[string]string{"alg": "ES256", "kid": ts.KeyID}
+	claims := map[string]interface{}{"iss": ts.TeamID, "iat": now.Unix()}
+	return signES256(ts.key, header, claims)
+}
+
+// Returns a JWT with the header and claims, signed with the key.
+func signES256(key *ecdsa.PrivateKey, header, claims interface{}) (string, error) {
+	headerJSON, err := json.Marshal(header)
+	if err != nil {
+		return "", err
+	}
+	claimsJSON, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	enc := base64.RawURLEncoding
+	unsigned := enc.EncodeToString(headerJSON) + "." + enc.EncodeToString(claimsJSON)
+	hash := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign token: %v", err)
+	}
+	// JWS wants the raw R || S, each padded to the curve size.
+	size := (key.Curve.Params().BitSize + 7) / 8
+	sig := make([]byte, 2*size)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[size-len(rb):size], rb)
+	copy(sig[2*size-len(sb):], sb)
+	return unsigned + "." + enc.EncodeToString(sig), nil
+}
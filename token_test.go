@@ -0,0 +1,28 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"testing"
+)
+
+func TestTokenSignerResetOnlyRejectedToken(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := &TokenSigner{KeyID: "key", TeamID: "team", key: key}
+	stale, _ := ts.Token()
+	ts.Reset(stale)
+	fresh, _ := ts.Token()
+	if fresh == stale {
+		t.Fatal("rejected token wasn't regenerated")
+	}
+	// A push signed with the old token coming back late mustn't discard the
+	// new one.
+	ts.Reset(stale)
+	if token, _ := ts.Token(); token != fresh {
+		t.Error("current token was regenerated for an old rejection")
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Delivery events are dropped rather than slowing down pushes when this many
+// are waiting to be sent.
+const WebhookQueueSize = 1000
+
+// DeliveryEvent is what gets posted to the webhook once a push resolves.
+type DeliveryEvent struct {
+	AccountID int64  `json:"account_id"`
+	ApnsID    string `json:"apns_id,omitempty"`
+	App       string `json:"app"`
+	LatencyMs int64  `json:"latency_ms"`
+	// Outcome is "success", "failed" (permanently) or "dropped".
+	Outcome   string `json:"outcome"`
+	TokenHash string `json:"token_hash"`
+}
+
+func NewDeliveryEvent(payload Payload, result Result, latency time.Duration) DeliveryEvent {
+	hash := sha256.Sum256([]byte(payload.DeviceToken))
+	event := DeliveryEvent{
+		AccountID: payload.AccountID,
+		ApnsID:    result.ID,
+		App:       payload.App,
+		LatencyMs: int64(latency / time.Millisecond),
+		Outcome:   "dropped",
+		TokenHash: hex.EncodeToString(hash[:]),
+	}
+	if result.Success {
+		event.Outcome = "success"
+	} else if result.Permanent {
+		event.Outcome = "failed"
+	}
+	return event
+}
+
+// DeviceDeletedEvent is what gets posted to the device webhook when a device is
+// deleted because the push provider rejected its token.
+type DeviceDeletedEvent struct {
+	AccountID   int64     `json:"account_id"`
+	DeviceToken string    `json:"device_token"`
+	Namespace   string    `json:"namespace,omitempty"`
+	Time        time.Time `json:"time"`
+}
+
+// Webhook posts events (DeliveryEvent or DeviceDeletedEvent) to a URL in the
+// background, on a best-effort basis.
+type Webhook struct {
+	URL    string
+	Secret string
+
+	client *http.Client
+	events chan interface{}
+}
+
+func NewWebhook(url, secret string) *Webhook {
+	hook := &Webhook{
+		URL:    url,
+		Secret: secret,
+		client: &http.Client{Timeout: 5 * time.Second},
+		events: make(chan interface{}, WebhookQueueSize),
+	}
+	go hook.run()
+	return hook
+}
+
+// Send queues the event without blocking, dropping it if the queue is full.
+func (h *Webhook) Send(event interface{}) {
+	select {
+	case h.events <- event:
+	default:
+		slog.Warn("Dropping webhook event", "event", "webhook_dropped", "url", h.URL)
+	}
+}
+
+func (h *Webhook) run() {
+	for event := range h.events {
+		if err := h.post(event); err != nil {
+			slog.Error("Failed to post webhook event", "event", "webhook_failed", "url", h.URL, "error", err)
+		}
+	}
+}
+
+func (h *Webhook) post(event interface{}) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", h.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if h.Secret != "" {
+		req.Header.Set("Authorization", "Bearer "+h.Secret)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook responded with %d", resp.StatusCode)
+	}
+	return nil
+}
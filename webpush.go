@@ -0,0 +1,284 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const PlatformWeb = "web"
+
+const (
+	// Push services only have to accept bodies up to 4096 bytes, which leaves
+	// this much for the data once it's encrypted.
+	MaxPayloadSizeWeb = 4096 - webPushHeaderSize - 1 - 16
+	// The VAPID token lifetime, which push services cap at 24 hours.
+	VAPIDLifetime = 12 * time.Hour
+
+	webPushHeaderSize = 16 + 4 + 1 + 65
+	webPushRecordSize = 4096
+)
+
+var (
+	// Signs Web Push requests when VAPID_PRIVATE_KEY is set, otherwise nil.
+	vapid     *VAPIDSigner
+	webClient = &http.Client{Timeout: 3 * time.Second}
+)
+
+// WebSubscription is a browser's PushSubscription as JSON, which web devices
+// use as their token.
+type WebSubscription struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		Auth   string `json:"auth"`
+		P256dh string `json:"p256dh"`
+	} `json:"keys"`
+}
+
+// ParseWebSubscription decodes a device token into a subscription, checking
+// that everything needed to encrypt for it is there.
+func ParseWebSubscription(token string) (sub WebSubscription, authSecret, publicKey []byte, err error) {
+	if err = json.Unmarshal([]byte(token), &sub); err != nil {
+		err = PayloadError{BadToken: true, Reason: "malformed web push subscription"}
+		return
+	}
+	if u, e := url.Parse(sub.Endpoint); e != nil || u.Scheme != "https" || u.Host == "" {
+		err = PayloadError{BadToken: true, Reason: "invalid web push endpoint"}
+		return
+	}
+	enc := base64.RawURLEncoding
+	authSecret, e1 := enc.DecodeString(sub.Keys.Auth)
+	publicKey, e2 := enc.DecodeString(sub.Keys.P256dh)
+	if e1 != nil || e2 != nil || len(authSecret) != 16 || len(publicKey) != 65 {
+		err = PayloadError{BadToken: true, Reason: "invalid web push subscription keys"}
+	}
+	return
+}
+
+// VAPIDSigner identifies this service to push services (RFC 8292).
+type VAPIDSigner struct {
+	Subject string
+
+	key       *ecdsa.PrivateKey
+	publicKey string
+}
+
+// NewVAPIDSigner takes the private key as a base64url encoded P-256 scalar, as
+// generated by most web push libraries, and a mailto: or https: subject.
+func NewVAPIDSigner(privateKey, subject string) (*VAPIDSigner, error) {
+	d, err := base64.RawURLEncoding.DecodeString(privateKey)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID private key: %v", err)
+	}
+	key, err := ecdh.P256().NewPrivateKey(d)
+	if err != nil {
+		return nil, fmt.Errorf("invalid VAPID private key: %v", err)
+	}
+	public := key.PublicKey().Bytes()
+	return &VAPIDSigner{
+		Subject: subject,
+		key: &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(public[1:33]),
+				Y:     new(big.Int).SetBytes(public[33:]),
+			},
+			D: new(big.Int).SetBytes(d),
+		},
+		publicKey: base64.RawURLEncoding.EncodeToString(public),
+	}, nil
+}
+
+// Authorization returns the Authorization header for a request to endpoint.
+func (v *VAPIDSigner) Authorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header := map[string]string{"typ": "JWT", "alg": "ES256"}
+	claims := map[string]interface{}{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(VAPIDLifetime).Unix(),
+		"sub": v.Subject,
+	}
+	token, err := signES256(v.key, header, claims)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("vapid t=%s, k=%s", token, v.publicKey), nil
+}
+
+// NewWebPushRequest encrypts the payload data for the subscription in the
+// device token and builds the request to its push service.
+func NewWebPushRequest(ctx context.Context, payload Payload) (req *http.Request, err error) {
+	if vapid == nil {
+		err = errors.New("web push is not configured")
+		return
+	}
+	sub, authSecret, publicKey, err := ParseWebSubscription(payload.DeviceToken)
+	if err != nil {
+		return
+	}
+	if len(payload.Data) > MaxPayloadSizeWeb {
+		err = PayloadError{Reason: fmt.Sprintf("data is %d bytes, limit is %d", len(payload.Data), MaxPayloadSizeWeb), TooLarge: true}
+		return
+	}
+	body, err := encryptWebPush(payload.Data, authSecret, publicKey)
+	if err != nil {
+		return
+	}
+	req, err = http.NewRequestWithContext(ctx, "POST", sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return
+	}
+	ttl := int64(DefaultExpiration / time.Second)
+	if payload.Expiration != nil {
+		if ttl = *payload.Expiration - time.Now().Unix(); ttl < 0 {
+			ttl = 0
+		}
+	}
+	if payload.Immediate {
+		ttl = 0
+	}
+	auth, err := vapid.Authorization(sub.Endpoint)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.FormatInt(ttl, 10))
+	if payload.Priority == 10 {
+		req.Header.Set("Urgency", "high")
+	}
+	if payload.CollapseID != "" {
+		req.Header.Set("Topic", payload.CollapseID)
+	}
+	return
+}
+
+type webStatus struct {
+	StatusCode int
+	Reason     string
+}
+
+// Statuses a push service may respond with, mapped onto the APNS status codes
+// and reasons that PushError understands. Only 404 and 410 mean that the
+// subscription is gone.
+var webStatusCodes = map[int]webStatus{
+	400: {400, "BadRequest"},
+	401: {403, "InvalidProviderToken"},
+	403: {403, "InvalidProviderToken"},
+	404: {410, "Unregistered"},
+	410: {410, "Unregistered"},
+	413: {400, "PayloadTooLarge"},
+	429: {429, ""},
+}
+
+// PushWeb delivers a notification to a browser through its push service, and
+// returns the message URL the push service assigned and how long it took to
+// respond.
+func PushWeb(ctx context.Context, payload Payload) (messageID string, latency time.Duration, err error) {
+	req, err := NewWebPushRequest(ctx, payload)
+	if err != nil {
+		return
+	}
+	start := time.Now()
+	resp, err := webClient.Do(req)
+	latency = time.Since(start)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		messageID = resp.Header.Get("Location")
+		return
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return
+	}
+	status, ok := webStatusCodes[resp.StatusCode]
+	if !ok {
+		status.StatusCode = http.StatusServiceUnavailable
+	}
+	err = PushError{
+		Body:       body,
+		Reason:     status.Reason,
+		RetryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		StatusCode: status.StatusCode,
+	}
+	return
+}
+
+// Encrypts data as a single aes128gcm record (RFC 8188) with the keys derived
+// as described in RFC 8291.
+func encryptWebPush(data, authSecret, uaPublic []byte) ([]byte, error) {
+	curve := ecdh.P256()
+	peer, err := curve.NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, PayloadError{BadToken: true, Reason: "invalid web push subscription keys"}
+	}
+	local, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := local.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	asPublic := local.PublicKey().Bytes()
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublic...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := hkdf(authSecret, secret, keyInfo, 32)
+	cek := hkdf(salt, ikm, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := hkdf(salt, ikm, []byte("Content-Encoding: nonce\x00"), 12)
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	header := make([]byte, 0, webPushHeaderSize)
+	header = append(header, salt...)
+	header = binary.BigEndian.AppendUint32(header, webPushRecordSize)
+	header = append(header, byte(len(asPublic)))
+	header = append(header, asPublic...)
+	// The 0x02 delimiter marks this as the last (and only) record.
+	plaintext := append(append([]byte{}, data...), 2)
+	return gcm.Seal(header, nonce, plaintext, nil), nil
+}
+
+// HKDF with SHA-256, for outputs of up to one hash in length.
+func hkdf(salt, ikm, info []byte, length int) []byte {
+	extract := hmac.New(sha256.New, salt)
+	extract.Write(ikm)
+	expand := hmac.New(sha256.New, extract.Sum(nil))
+	expand.Write(info)
+	expand.Write([]byte{1})
+	return expand.Sum(nil)[:length]
+}